@@ -46,13 +46,20 @@
 package age
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
 	"sort"
+	"strings"
 
+	"filippo.io/age/armor"
 	"filippo.io/age/internal/format"
 	"filippo.io/age/internal/stream"
 )
@@ -65,6 +72,11 @@ import (
 // recipient stanzas match the identity, any other error will be considered
 // fatal.
 //
+// The same Identity can be passed to concurrent Decrypt calls, so
+// implementations should be safe for concurrent use by multiple goroutines.
+// All Identity implementations in this module, including X25519Identity,
+// ScryptIdentity, and those in the agessh package, are.
+//
 // Most age API users won't need to interact with this directly, and should
 // instead pass Recipient implementations to Encrypt and Identity
 // implementations to Decrypt.
@@ -74,6 +86,41 @@ type Identity interface {
 
 var ErrIncorrectIdentity = errors.New("incorrect identity for recipient block")
 
+// IdentityWithHeader can be optionally implemented by an Identity, in which
+// case Decrypt will use UnwrapWithHeader instead of Unwrap.
+//
+// header is the encoded header of the file up to and including the "---" that
+// introduces the MAC, which is the input of the header MAC. It includes all the
+// recipient stanzas, and can be used by experimental recipient designs to bind
+// the file key to the rest of the header. UnwrapWithHeader must not modify or
+// retain it.
+//
+// Note that the header MAC is only checked after the file key is unwrapped.
+type IdentityWithHeader interface {
+	UnwrapWithHeader(stanzas []*Stanza, header []byte) (fileKey []byte, err error)
+}
+
+// IdentityFunc is an adapter to allow the use of ordinary functions as
+// identities, like http.HandlerFunc. If f is a function with the appropriate
+// signature, IdentityFunc(f) is an Identity that calls f.
+//
+// Like any Unwrap implementation, f must return an error wrapping
+// ErrIncorrectIdentity if none of the stanzas match, not a nil file key or a
+// different error, which would be fatal. As a safeguard, a nil file key with a
+// nil error is reported as a fatal error.
+type IdentityFunc func(stanzas []*Stanza) (fileKey []byte, err error)
+
+var _ Identity = IdentityFunc(nil)
+
+// Unwrap calls f(stanzas).
+func (f IdentityFunc) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	fileKey, err := f(stanzas)
+	if err == nil && fileKey == nil {
+		return nil, errors.New("age: IdentityFunc returned neither a file key nor an error")
+	}
+	return fileKey, err
+}
+
 // A Recipient is passed to Encrypt to wrap an opaque file key to one or more
 // recipient stanza(s). It can be for example a public key like X25519Recipient,
 // a plugin, or a custom implementation.
@@ -90,7 +137,8 @@ type Recipient interface {
 //
 // Encrypt will succeed only if the labels returned by all the recipients
 // (assuming the empty set for those that don't implement RecipientWithLabels)
-// are the same.
+// are the same. Labels are compared as sets, so their order doesn't matter.
+// Encrypt doesn't modify the returned slice.
 //
 // This can be used to ensure a recipient is only used with other recipients
 // with equivalent properties (for example by setting a "postquantum" label) or
@@ -100,6 +148,44 @@ type RecipientWithLabels interface {
 	WrapWithLabels(fileKey []byte) (s []*Stanza, labels []string, err error)
 }
 
+// ErrIncomparableRecipients is returned by SameRecipient if it can't determine
+// whether two recipients are equivalent.
+var ErrIncomparableRecipients = errors.New("recipients can't be compared")
+
+// SameRecipient reports whether a and b refer to the same key, for example to
+// detect duplicates in a list of recipients.
+//
+// Recipients of different types are always considered different, even if they
+// are derived from the same key, because they produce different stanzas which
+// require different identities. Recipients of the same type are compared by
+// their String method, which must return a canonical encoding of the key, such
+// as the Bech32 encoding for X25519Recipient or the SSH public key for agessh
+// recipients (ignoring comments). If they don't implement fmt.Stringer, or
+// String returns an empty string (like for plugin recipients returned by
+// plugin.Identity.Recipient), SameRecipient returns ErrIncomparableRecipients,
+// unless a and b are the same value.
+func SameRecipient(a, b Recipient) (bool, error) {
+	if a == nil || b == nil {
+		return false, errors.New("nil recipient")
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false, nil
+	}
+	// Comparing interface values with uncomparable dynamic types panics.
+	if reflect.TypeOf(a).Comparable() && a == b {
+		return true, nil
+	}
+	sa, ok := a.(fmt.Stringer)
+	if !ok {
+		return false, ErrIncomparableRecipients
+	}
+	sb := b.(fmt.Stringer)
+	if sa.String() == "" || sb.String() == "" {
+		return false, ErrIncomparableRecipients
+	}
+	return sa.String() == sb.String(), nil
+}
+
 // A Stanza is a section of the age header that encapsulates the file key as
 // encrypted to a specific recipient.
 //
@@ -122,23 +208,152 @@ const streamNonceSize = 16
 //
 // The caller must call Close on the WriteCloser when done for the last chunk to
 // be encrypted and flushed to dst.
+//
+// Memory use doesn't depend on the size of the plaintext: the WriteCloser
+// buffers at most one 64 KiB chunk plus its 16 byte tag, in addition to the
+// header, which is written to dst before Encrypt returns.
 func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	return EncryptWithOptions(dst, nil, recipients...)
+}
+
+// An EncryptOption configures the behavior of EncryptWithOptions.
+type EncryptOption func(*encryptOptions)
+
+type encryptOptions struct {
+	filename  string
+	observer  func(recipientIndex int, s *Stanza)
+	minReader string
+
+	// fileKey and nonce, if not nil, replace the random values. They are
+	// only set by TestingEncrypt.
+	fileKey, nonce []byte
+
+	// ctx, if not nil, is checked before each recipient is used. It's only
+	// set by EncryptContext.
+	ctx context.Context
+}
+
+// WithFilename stores name, the base name of the file being encrypted, in the
+// header, so that it can be retrieved with WithStoredFilename. name must not
+// contain path separators, and must be at most 255 bytes long.
+//
+// The name is encrypted with a key derived from the file key, in an
+// additional "filename" stanza. Only the presence of a stored name and its
+// length are visible without the file key. Other age implementations ignore
+// the stanza and decrypt the file as usual, but since it adds a stanza, it
+// can't be used with ScryptRecipient.
+func WithFilename(name string) EncryptOption {
+	return func(o *encryptOptions) { o.filename = name }
+}
+
+// WithStanzaObserver makes EncryptWithOptions call observe for each stanza
+// produced by each recipient, in order, for example to log the ephemeral share
+// of an X25519 stanza while debugging. recipientIndex is the position of the
+// recipient in the recipients argument.
+//
+// observe receives a copy of the stanza with only its type and arguments. The
+// body, which carries the wrapped file key, is always nil.
+func WithStanzaObserver(observe func(recipientIndex int, s *Stanza)) EncryptOption {
+	return func(o *encryptOptions) { o.observer = observe }
+}
+
+// WithMinReaderVersion makes EncryptWithOptions fail if the file couldn't be
+// decrypted by version of this package or of the age CLI, for example because
+// a recipient type was introduced in a later release. version must be a known
+// age release, such as "v1.0.0" (the "v" is optional).
+//
+// Stanzas of types not natively supported by age, such as those produced by
+// plugins, require v1.1.0, the first release with plugin support, and the
+// right plugin installed. The stanza added by WithFilename is not checked, as
+// every release ignores it when decrypting.
+func WithMinReaderVersion(version string) EncryptOption {
+	return func(o *encryptOptions) { o.minReader = strings.TrimPrefix(version, "v") }
+}
+
+// EncryptWithOptions is like Encrypt, but its behavior can be customized by
+// passing one or more EncryptOption values.
+func EncryptWithOptions(dst io.Writer, opts []EncryptOption, recipients ...Recipient) (io.WriteCloser, error) {
+	o := &encryptOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	if len(recipients) == 0 {
 		return nil, errors.New("no recipients specified")
 	}
+	if o.filename != "" {
+		if err := checkFilename(o.filename); err != nil {
+			return nil, err
+		}
+	}
+	if o.minReader != "" {
+		if !knownRelease(o.minReader) {
+			return nil, fmt.Errorf("unknown age release v%s", o.minReader)
+		}
+	}
 
 	fileKey := make([]byte, fileKeySize)
-	if _, err := rand.Read(fileKey); err != nil {
+	if o.fileKey != nil {
+		copy(fileKey, o.fileKey)
+	} else if _, err := rand.Read(fileKey); err != nil {
 		return nil, err
 	}
 
+	hdr, err := wrapFileKey(fileKey, o, recipients)
+	if err != nil {
+		return nil, err
+	}
+	if o.filename != "" {
+		// The filename stanza is not subject to minReader: all releases skip
+		// stanzas that no identity matches, as long as there is no scrypt one.
+		body, err := aeadEncrypt(filenameKey(fileKey), []byte(o.filename))
+		if err != nil {
+			return nil, err
+		}
+		hdr.Recipients = append(hdr.Recipients, &format.Stanza{
+			Type: filenameStanzaType, Body: body,
+		})
+	}
+	if mac, err := headerMAC(fileKey, hdr); err != nil {
+		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+	} else {
+		hdr.MAC = mac
+	}
+	if err := hdr.Marshal(dst); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if o.nonce != nil {
+		copy(nonce, o.nonce)
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return nil, fmt.Errorf("failed to write nonce: %v", err)
+	}
+
+	return stream.NewWriter(streamKey(fileKey, nonce), dst)
+}
+
+// wrapFileKey wraps fileKey for each recipient, checks their labels are
+// compatible, and returns a header with the resulting stanzas and no MAC.
+func wrapFileKey(fileKey []byte, o *encryptOptions, recipients []Recipient) (*format.Header, error) {
 	hdr := &format.Header{}
 	var labels []string
 	for i, r := range recipients {
+		if o.ctx != nil {
+			if err := o.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		stanzas, l, err := wrapWithLabels(r, fileKey)
 		if err != nil {
 			return nil, fmt.Errorf("failed to wrap key for recipient #%d: %v", i, err)
 		}
+		// Labels are a set, so compare them in sorted order, without sorting
+		// the slice owned by the recipient.
+		l = append([]string(nil), l...)
 		sort.Strings(l)
 		if i == 0 {
 			labels = l
@@ -146,27 +361,90 @@ func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
 			return nil, fmt.Errorf("incompatible recipients")
 		}
 		for _, s := range stanzas {
+			if o.minReader != "" && !readerSupports(o.minReader, s.Type) {
+				return nil, fmt.Errorf("recipient #%d (%T) produces %s stanzas, which are not supported by age v%s",
+					i, r, s.Type, o.minReader)
+			}
 			hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+			if o.observer != nil {
+				o.observer(i, &Stanza{Type: s.Type, Args: append([]string{}, s.Args...)})
+			}
 		}
 	}
-	if mac, err := headerMAC(fileKey, hdr); err != nil {
-		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
-	} else {
-		hdr.MAC = mac
+	return hdr, nil
+}
+
+// EncryptedSize returns the exact size of the age file that Encrypt would
+// produce when encrypting plaintextSize bytes to recipients.
+//
+// To measure the header, EncryptedSize wraps a random file key with each
+// recipient, which might be slow (for ScryptRecipient) or interactive (for
+// plugins). The result is exact only if the recipients always produce stanzas
+// of the same size, which is the case for all the recipient types implemented
+// by this module. Encryption options such as WithFilename are not taken into
+// account.
+//
+// The size is that of the binary encoding. For ASCII armored files, pass the
+// result to armor.EncodedSize.
+func EncryptedSize(plaintextSize int64, recipients []Recipient) (int64, error) {
+	if len(recipients) == 0 {
+		return 0, errors.New("no recipients specified")
 	}
-	if err := hdr.Marshal(dst); err != nil {
-		return nil, fmt.Errorf("failed to write header: %v", err)
+	payloadSize, err := stream.EncryptedSize(plaintextSize)
+	if err != nil {
+		return 0, err
 	}
 
-	nonce := make([]byte, streamNonceSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, err
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return 0, err
 	}
-	if _, err := dst.Write(nonce); err != nil {
-		return nil, fmt.Errorf("failed to write nonce: %v", err)
+	hdr, err := wrapFileKey(fileKey, &encryptOptions{}, recipients)
+	if err != nil {
+		return 0, err
+	}
+	hdr.MAC = make([]byte, sha256.Size)
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return 0, fmt.Errorf("failed to measure header: %v", err)
 	}
 
-	return stream.NewWriter(streamKey(fileKey, nonce), dst)
+	return int64(buf.Len()) + streamNonceSize + payloadSize, nil
+}
+
+// PlaintextSizeFromFileSize returns the size of the plaintext of a binary age
+// file of fileSize bytes, without decrypting it. It's the inverse of
+// EncryptedSize.
+//
+// The header has a variable size, so it's read from src, which must be
+// positioned at the start of the file. Nothing is read from src past the end
+// of the header, so the first bytes of an io.ReaderAt can be passed in with
+// io.NewSectionReader. No identity is needed, so the header MAC is not checked.
+//
+// An error is returned if src is ASCII armored, or if fileSize is not
+// consistent with the size of the header and the payload encryption.
+func PlaintextSizeFromFileSize(src io.Reader, fileSize int64) (int64, error) {
+	rr := bufio.NewReader(src)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		return 0, errors.New("armored files are not supported")
+	}
+	hdr, _, err := format.Parse(rr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return 0, fmt.Errorf("failed to serialize header: %v", err)
+	}
+	payloadSize := fileSize - int64(buf.Len()) - streamNonceSize
+	if payloadSize < 0 {
+		return 0, errors.New("file is too short to contain the header and nonce")
+	}
+	size, err := stream.PlaintextSize(payloadSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid payload size: %v", err)
+	}
+	return size, nil
 }
 
 func wrapWithLabels(r Recipient, fileKey []byte) (s []*Stanza, labels []string, err error) {
@@ -189,6 +467,14 @@ func slicesEqual(s1, s2 []string) bool {
 	return true
 }
 
+// ErrNotAnAgeFile is wrapped by the errors returned by Decrypt and the other
+// functions that read an age header, if the input is not an age file at all, as
+// opposed to a malformed or truncated one.
+//
+// ASCII armored files are also reported as ErrNotAnAgeFile by Decrypt, unless
+// they are decoded first with the armor package.
+var ErrNotAnAgeFile = format.ErrNotAgeFile
+
 // NoIdentityMatchError is returned by Decrypt when none of the supplied
 // identities match the encrypted file.
 type NoIdentityMatchError struct {
@@ -201,37 +487,283 @@ func (*NoIdentityMatchError) Error() string {
 	return "no identity matched any of the recipients"
 }
 
+// An IdentityProvider can be passed to DecryptWithOptions with
+// WithIdentityProvider to lazily resolve the identities that might be able to
+// decrypt a file, for example by looking them up in a database by recipient
+// stanza type or arguments.
+type IdentityProvider interface {
+	// Identities returns the identities to try for a file with the given
+	// recipient stanzas. It's called by DecryptWithOptions at most once per
+	// file, and only if none of the statically provided identities matched.
+	// Any error is considered fatal.
+	Identities(stanzas []*Stanza) ([]Identity, error)
+}
+
+// A DecryptOption configures the behavior of DecryptWithOptions.
+type DecryptOption func(*decryptOptions)
+
+type decryptOptions struct {
+	providers    []IdentityProvider
+	filename     *string
+	concatenated bool
+
+	// checkStanzas, if not nil, is called with the recipient stanzas after the
+	// header MAC is verified. It's only set by DecryptExpectingRecipients.
+	checkStanzas func([]*Stanza) error
+
+	// fileKey, if not nil, is set to the unwrapped file key after the header
+	// MAC is verified. It's only set by DecryptWithFileKey.
+	fileKey *[]byte
+
+	// ctx, if not nil, is checked before each identity is used. It's only
+	// set by DecryptContext.
+	ctx context.Context
+}
+
+// WithConcatenatedFiles makes DecryptWithOptions accept a sequence of one or
+// more binary age files concatenated together, and return a Reader that
+// decrypts each of them in turn and returns the concatenation of their
+// plaintexts. Each file must be decryptable with the provided identities, and
+// the other options apply to each of them.
+//
+// The end of each file is detected by finding the intro of the next one right
+// after an authentic final payload chunk.
+func WithConcatenatedFiles() DecryptOption {
+	return func(o *decryptOptions) { o.concatenated = true }
+}
+
+// WithStoredFilename makes DecryptWithOptions set *name to the file name stored
+// with WithFilename, or to the empty string if the file doesn't have one.
+//
+// The stored name is checked to be a base name without path separators, but
+// it's otherwise chosen by the sender of the file. Applications should not
+// overwrite existing files with it.
+func WithStoredFilename(name *string) DecryptOption {
+	return func(o *decryptOptions) { o.filename = name }
+}
+
+// WithIdentityProvider makes DecryptWithOptions try the identities returned by
+// p after the ones passed to it directly. It can be repeated, in which case
+// providers are consulted in order until one of their identities matches.
+func WithIdentityProvider(p IdentityProvider) DecryptOption {
+	return func(o *decryptOptions) { o.providers = append(o.providers, p) }
+}
+
 // Decrypt decrypts a file encrypted to one or more identities.
 //
 // It returns a Reader reading the decrypted plaintext of the age file read
 // from src. All identities will be tried until one successfully decrypts the file.
+//
+// The returned Reader also implements a Progress method
+//
+//	Progress() (currentChunk, totalChunks int64)
+//
+// which returns the number of 64 KiB payload chunks decrypted so far, and the
+// total number of chunks in the file. The total is known only if src has a
+// Size method reporting the size of the whole file, like *io.SectionReader,
+// *bytes.Reader, and *strings.Reader, in which case src must be read from the
+// start. Otherwise, totalChunks is -1.
+//
+// Memory use doesn't depend on the size of the file: after the header is
+// parsed, the Reader holds one encrypted chunk of 64 KiB plus a 16 byte tag and
+// one decrypted chunk of 64 KiB, in addition to a 4 KiB buffer used while
+// parsing the header.
 func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
-	if len(identities) == 0 {
+	return DecryptWithOptions(src, nil, identities...)
+}
+
+// DecryptWithOptions is like Decrypt, but its behavior can be customized by
+// passing one or more DecryptOption values.
+//
+// If an IdentityProvider is passed with WithIdentityProvider, identities may
+// be empty.
+//
+// With WithConcatenatedFiles, the returned Reader doesn't implement the
+// Progress method documented on Decrypt, since it might read multiple files.
+func DecryptWithOptions(src io.Reader, opts []DecryptOption, identities ...Identity) (io.Reader, error) {
+	o := &decryptOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if len(identities) == 0 && len(o.providers) == 0 {
 		return nil, errors.New("no identities specified")
 	}
 
+	r, err := decryptFile(src, o, identities)
+	if err != nil {
+		return nil, err
+	}
+	if o.concatenated {
+		return &concatenatedReader{r: r, o: o, identities: identities}, nil
+	}
+	return r, nil
+}
+
+// DecryptWithFileKey is like Decrypt, but it also returns the file key that
+// one of the identities unwrapped from the header, after checking the header
+// MAC with it. This is meant for envelope encryption schemes that bind
+// external data, for example metadata stored elsewhere, to the file.
+//
+// This is a low-level, advanced API. The file key is enough to decrypt the
+// file, and to produce new headers for it, so it must be handled as carefully
+// as the plaintext. The caller must not use it directly as a key for anything
+// else, but only derive other keys from it, with a KDF like HKDF and a label
+// unique to the application.
+func DecryptWithFileKey(src io.Reader, identities ...Identity) (io.Reader, []byte, error) {
+	if len(identities) == 0 {
+		return nil, nil, errors.New("no identities specified")
+	}
+	var fileKey []byte
+	r, err := decryptFile(src, &decryptOptions{fileKey: &fileKey}, identities)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, fileKey, nil
+}
+
+// DecryptReaderAt is like Decrypt, but it provides random access to the
+// plaintext of the age file of the given size read from src.
+//
+// It reads and decrypts the header, and returns an io.ReaderAt along with the
+// size of the plaintext. Each ReadAt call only reads and decrypts the 64 KiB
+// payload chunks it overlaps, so any part of a large file can be read without
+// processing what comes before it. The last chunk is decrypted before
+// DecryptReaderAt returns, so that a truncated file is detected and the size
+// can be trusted, for example to build an io.SectionReader. Every other chunk
+// is authenticated when it's first read.
+//
+// ASCII armored files are not supported, since they can't be decoded with
+// random access. The returned ReaderAt is safe for concurrent use.
+func DecryptReaderAt(src io.ReaderAt, encryptedSize int64, identities ...Identity) (io.ReaderAt, int64, error) {
+	key, payload, err := decryptHeaderAt(src, encryptedSize, identities)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := stream.NewDecryptReaderAt(key, payload, payload.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, r.Size(), nil
+}
+
+// DecryptParallel is like Decrypt, but it reads the age file of the given size
+// from src, and decrypts the 64 KiB payload chunks ahead of the reader with up
+// to workers goroutines, which can improve throughput for large files on
+// multi-core machines. A good default for workers is runtime.GOMAXPROCS(0).
+//
+// Like DecryptReaderAt, it decrypts the last chunk before returning, so that a
+// truncated file is detected early, and it doesn't support ASCII armored files.
+// The returned ReadCloser holds up to 2 × workers decrypted chunks. It must be
+// closed to stop the workers if it's not read until io.EOF.
+func DecryptParallel(src io.ReaderAt, encryptedSize int64, workers int, identities ...Identity) (io.ReadCloser, error) {
+	key, payload, err := decryptHeaderAt(src, encryptedSize, identities)
+	if err != nil {
+		return nil, err
+	}
+	return stream.NewParallelDecryptReader(key, payload, payload.Size(), workers)
+}
+
+// decryptHeaderAt decrypts the header of the binary age file of the given size
+// read from src, and returns the payload key and the payload.
+func decryptHeaderAt(src io.ReaderAt, encryptedSize int64, identities []Identity) ([]byte, *io.SectionReader, error) {
+	if len(identities) == 0 {
+		return nil, nil, errors.New("no identities specified")
+	}
+	rr := bufio.NewReader(io.NewSectionReader(src, 0, encryptedSize))
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		return nil, nil, errors.New("armored files are not supported with random access")
+	}
+	hdr, _, err := format.Parse(rr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	fileKey, err := decryptHeader(hdr, &decryptOptions{}, identities)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to serialize header: %v", err)
+	}
+	payloadOffset := int64(buf.Len()) + streamNonceSize
+	if encryptedSize < payloadOffset {
+		return nil, nil, errors.New("file is too short to contain the header and nonce")
+	}
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(io.NewSectionReader(src, int64(buf.Len()), streamNonceSize), nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	payload := io.NewSectionReader(src, payloadOffset, encryptedSize-payloadOffset)
+	return streamKey(fileKey, nonce), payload, nil
+}
+
+// decryptFile decrypts the header of the age file read from src, and returns
+// a Reader for its payload.
+func decryptFile(src io.Reader, o *decryptOptions, identities []Identity) (*stream.Reader, error) {
 	hdr, payload, err := format.Parse(src)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
 
+	fileKey, err := decryptHeader(hdr, o, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	r, err := stream.NewReader(streamKey(fileKey, nonce), payload)
+	if err != nil {
+		return nil, err
+	}
+	if o.concatenated {
+		r.SetBoundary([]byte(BinaryMagic))
+	} else if src, ok := src.(interface{ Size() int64 }); ok {
+		h := &bytes.Buffer{}
+		if err := hdr.Marshal(h); err != nil {
+			return nil, fmt.Errorf("failed to serialize header: %v", err)
+		}
+		r.SetCiphertextSize(src.Size() - int64(h.Len()) - streamNonceSize)
+	}
+	return r, nil
+}
+
+// decryptHeader unwraps the file key from hdr with identities, checks the
+// header MAC, and applies the options that concern the header. It returns the
+// file key to derive the payload key from.
+func decryptHeader(hdr *format.Header, o *decryptOptions, identities []Identity) ([]byte, error) {
 	stanzas := make([]*Stanza, 0, len(hdr.Recipients))
 	for _, s := range hdr.Recipients {
 		stanzas = append(stanzas, (*Stanza)(s))
 	}
+	header := &bytes.Buffer{}
+	if err := hdr.MarshalWithoutMAC(header); err != nil {
+		return nil, fmt.Errorf("failed to serialize header: %v", err)
+	}
 	errNoMatch := &NoIdentityMatchError{}
-	var fileKey []byte
-	for _, id := range identities {
-		fileKey, err = id.Unwrap(stanzas)
-		if errors.Is(err, ErrIncorrectIdentity) {
-			errNoMatch.Errors = append(errNoMatch.Errors, err)
-			continue
+	fileKey, err := unwrapFileKey(o.ctx, identities, stanzas, header.Bytes(), errNoMatch)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range o.providers {
+		if fileKey != nil {
+			break
+		}
+		ids, err := p.Identities(stanzas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve identities: %w", err)
 		}
+		fileKey, err = unwrapFileKey(o.ctx, ids, stanzas, header.Bytes(), errNoMatch)
 		if err != nil {
 			return nil, err
 		}
-
-		break
 	}
 	if fileKey == nil {
 		return nil, errNoMatch
@@ -243,23 +775,217 @@ func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
 		return nil, errors.New("bad header MAC")
 	}
 
-	nonce := make([]byte, streamNonceSize)
-	if _, err := io.ReadFull(payload, nonce); err != nil {
-		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	if o.checkStanzas != nil {
+		if err := o.checkStanzas(stanzas); err != nil {
+			return nil, err
+		}
+	}
+	if o.fileKey != nil {
+		*o.fileKey = append([]byte(nil), fileKey...)
 	}
 
-	return stream.NewReader(streamKey(fileKey, nonce), payload)
+	if o.filename != nil {
+		*o.filename, err = storedFilename(fileKey, stanzas)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fileKey, nil
+}
+
+// concatenatedReader decrypts a sequence of concatenated age files, see
+// WithConcatenatedFiles.
+type concatenatedReader struct {
+	r          *stream.Reader
+	o          *decryptOptions
+	identities []Identity
+	files      int
+	err        error
+}
+
+func (c *concatenatedReader) Read(p []byte) (int, error) {
+	for c.err == nil {
+		n, err := c.r.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		c.files++
+		rest := bufio.NewReader(c.r.Rest())
+		if _, err := rest.Peek(1); err == io.EOF {
+			c.err = io.EOF
+		} else if err != nil {
+			c.err = err
+		} else if c.r, err = decryptFile(rest, c.o, c.identities); err != nil {
+			c.err = fmt.Errorf("failed to decrypt file #%d: %w", c.files+1, err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, c.err
+}
+
+// storedFilename decrypts the filename stanza, if any, and returns the name.
+func storedFilename(fileKey []byte, stanzas []*Stanza) (string, error) {
+	var name string
+	for _, s := range stanzas {
+		if s.Type != filenameStanzaType {
+			continue
+		}
+		if name != "" {
+			return "", errors.New("multiple filename stanzas")
+		}
+		if len(s.Args) != 0 {
+			return "", errors.New("invalid filename stanza")
+		}
+		n, err := decryptFilename(fileKey, s.Body)
+		if err != nil {
+			return "", err
+		}
+		if err := checkFilename(string(n)); err != nil {
+			return "", fmt.Errorf("invalid stored filename: %v", err)
+		}
+		name = string(n)
+	}
+	return name, nil
+}
+
+// ErrOutputTooLarge is returned by the Reader returned by DecryptLimited if the
+// plaintext is larger than the provided limit.
+var ErrOutputTooLarge = errors.New("decrypted output is larger than the limit")
+
+// DecryptLimited is like Decrypt, but the returned Reader returns
+// ErrOutputTooLarge instead of reading more than maxBytes of plaintext.
+//
+// Note that age does not compress, so the plaintext is always smaller than the
+// payload: each 64 KiB chunk of plaintext is encrypted into 64 KiB + 16 bytes,
+// following a 16 bytes nonce and the header. Limiting the size of src is
+// therefore sufficient to limit the size of the plaintext, but DecryptLimited
+// might be more convenient when the size of src is not known in advance.
+func DecryptLimited(src io.Reader, maxBytes int64, identities ...Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	r, err := decryptFile(src, &decryptOptions{}, identities)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReader{r: r, n: maxBytes}, nil
+}
+
+// limitedReader is like io.LimitedReader, but it returns ErrOutputTooLarge
+// if the underlying Reader has more than n bytes left.
+type limitedReader struct {
+	r   *stream.Reader
+	n   int64
+	err error
+}
+
+// Progress implements the Progress method documented on Decrypt.
+func (l *limitedReader) Progress() (currentChunk, totalChunks int64) {
+	return l.r.Progress()
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			err = ErrOutputTooLarge
+		}
+		if err != nil {
+			l.err = err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if err != nil {
+		l.err = err
+	}
+	return n, err
+}
+
+// ReKey decrypts the age file read from src with identities, and re-encrypts
+// its plaintext to dst for recipients, with a freshly generated file key.
+//
+// ReKey is for rotating a file key that might have been exposed, which
+// requires re-encrypting the whole payload. Changing the recipients of a file
+// without re-encrypting its payload would keep the same file key, and any
+// party that ever had it (such as a removed recipient who kept a copy of the
+// header) could still decrypt the file.
+//
+// Recipients can't be extracted from a file, so the caller must pass them
+// again, even if they are unchanged.
+//
+// The plaintext is streamed, and is never fully buffered in memory. If ReKey
+// returns an error, dst might contain a partial file, which must be discarded.
+func ReKey(src io.Reader, dst io.Writer, identities []Identity, recipients []Recipient) error {
+	r, err := Decrypt(src, identities...)
+	if err != nil {
+		return err
+	}
+	w, err := Encrypt(dst, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// unwrapFileKey tries each identity in order, and returns the first file key
+// successfully unwrapped, or nil if none matched. Errors wrapping
+// ErrIncorrectIdentity are appended to errNoMatch, any other error is returned.
+// header is passed to identities that implement IdentityWithHeader. If ctx is
+// not nil, it's checked before each identity is tried.
+func unwrapFileKey(ctx context.Context, identities []Identity, stanzas []*Stanza, header []byte, errNoMatch *NoIdentityMatchError) ([]byte, error) {
+	for _, id := range identities {
+		if ctx != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		var fileKey []byte
+		var err error
+		if hid, ok := id.(IdentityWithHeader); ok {
+			fileKey, err = hid.UnwrapWithHeader(stanzas, header)
+		} else {
+			fileKey, err = id.Unwrap(stanzas)
+		}
+		if errors.Is(err, ErrIncorrectIdentity) {
+			errNoMatch.Errors = append(errNoMatch.Errors, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return fileKey, nil
+	}
+	return nil, nil
 }
 
 // multiUnwrap is a helper that implements Identity.Unwrap in terms of a
 // function that unwraps a single recipient stanza.
+//
+// If none of the stanzas match, it returns the last error that wraps
+// ErrIncorrectIdentity with more details, like ErrIncorrectPassphrase, so
+// that it makes its way up through Decrypt into NoIdentityMatchError.Errors.
 func multiUnwrap(unwrap func(*Stanza) ([]byte, error), stanzas []*Stanza) ([]byte, error) {
+	errNoMatch := ErrIncorrectIdentity
 	for _, s := range stanzas {
 		fileKey, err := unwrap(s)
 		if errors.Is(err, ErrIncorrectIdentity) {
-			// If we ever start returning something interesting wrapping
-			// ErrIncorrectIdentity, we should let it make its way up through
-			// Decrypt into NoIdentityMatchError.Errors.
+			if err != ErrIncorrectIdentity {
+				errNoMatch = err
+			}
 			continue
 		}
 		if err != nil {
@@ -267,5 +993,5 @@ func multiUnwrap(unwrap func(*Stanza) ([]byte, error), stanzas []*Stanza) ([]byt
 		}
 		return fileKey, nil
 	}
-	return nil, ErrIncorrectIdentity
+	return nil, errNoMatch
 }
@@ -6,14 +6,28 @@ package age_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"filippo.io/age/plugin"
 )
 
 func ExampleEncrypt() {
@@ -41,6 +55,46 @@ func ExampleEncrypt() {
 	// Encrypted file size: 219
 }
 
+// byteCounter is an io.Writer that counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+func ExampleEncrypt_hash() {
+	publicKey := "age1cy0su9fwf3gf9mw868g5yut09p6nytfmmnktexz2ya5uqg9vl9sss4euqm"
+	recipient, err := age.ParseX25519Recipient(publicKey)
+	if err != nil {
+		log.Fatalf("Failed to parse public key %q: %v", publicKey, err)
+	}
+
+	// The ciphertext is hashed and counted as it's written to out, for
+	// example to produce a manifest, without buffering it.
+	out := io.Discard
+	h := sha256.New()
+	var size byteCounter
+
+	w, err := age.Encrypt(io.MultiWriter(out, h, &size), recipient)
+	if err != nil {
+		log.Fatalf("Failed to create encrypted file: %v", err)
+	}
+	if _, err := io.WriteString(w, "Black lives matter."); err != nil {
+		log.Fatalf("Failed to write to encrypted file: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Failed to close encrypted file: %v", err)
+	}
+
+	// The header and nonce are random, so the hash differs at every run.
+	fmt.Printf("Encrypted file size: %d\n", size)
+	fmt.Printf("Encrypted file SHA-256: %d bytes\n", len(h.Sum(nil)))
+	// Output:
+	// Encrypted file size: 219
+	// Encrypted file SHA-256: 32 bytes
+}
+
 // DO NOT hardcode the private key. Store it in a secret storage solution,
 // on disk if the local machine is trusted, or have the user provide it.
 var privateKey string
@@ -103,6 +157,41 @@ func ExampleParseIdentities() {
 	// File contents: "Black lives matter."
 }
 
+func ExampleDecryptReaderAt() {
+	identity, err := age.ParseX25519Identity(privateKey)
+	if err != nil {
+		log.Fatalf("Failed to parse private key: %v", err)
+	}
+
+	f, err := os.Open("testdata/example.age")
+	if err != nil {
+		log.Fatalf("Failed to open file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Failed to stat file: %v", err)
+	}
+
+	r, size, err := age.DecryptReaderAt(f, fi.Size(), identity)
+	if err != nil {
+		log.Fatalf("Failed to open encrypted file: %v", err)
+	}
+
+	// Only the chunks containing the requested bytes are read and decrypted,
+	// so this is just as fast at an offset of many gigabytes into a file.
+	offset := int64(6)
+	out := &bytes.Buffer{}
+	if _, err := io.Copy(out, io.NewSectionReader(r, offset, size-offset)); err != nil {
+		log.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	fmt.Printf("File size: %d\n", size)
+	fmt.Printf("File contents from offset %d: %q\n", offset, out.Bytes())
+	// Output:
+	// File size: 19
+	// File contents from offset 6: "lives matter."
+}
+
 func ExampleGenerateX25519Identity() {
 	identity, err := age.GenerateX25519Identity()
 	if err != nil {
@@ -152,16 +241,46 @@ func TestEncryptDecryptX25519(t *testing.T) {
 	}
 }
 
-func TestEncryptDecryptScrypt(t *testing.T) {
-	password := "twitch.tv/filosottile"
+func TestX25519ExtraArgument(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	stanzas, err := r.Wrap(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stanzas) != 1 || len(stanzas[0].Args) != 1 {
+		t.Fatalf("expected one X25519 stanza with one argument, got %v", stanzas)
+	}
+	// The spec requires exactly one argument, so a second one (of any
+	// length) must be rejected, rather than ignored or skipped.
+	stanzas[0].Args = append(stanzas[0].Args, "AAAAAA")
+	if _, err := i.Unwrap(stanzas); err == nil {
+		t.Error("expected an error for an X25519 stanza with two arguments")
+	} else if errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected a fatal error, got %v", err)
+	}
+}
 
-	r, err := age.NewScryptRecipient(password)
+type testIdentityProvider struct {
+	identities []age.Identity
+	calls      int
+}
+
+func (p *testIdentityProvider) Identities(stanzas []*age.Stanza) ([]age.Identity, error) {
+	p.calls++
+	return p.identities, nil
+}
+
+func TestIdentityProvider(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
 	if err != nil {
 		t.Fatal(err)
 	}
-	r.SetWorkFactor(15)
 	buf := &bytes.Buffer{}
-	w, err := age.Encrypt(buf, r)
+	w, err := age.Encrypt(buf, a.Recipient())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,12 +290,104 @@ func TestEncryptDecryptScrypt(t *testing.T) {
 	if err := w.Close(); err != nil {
 		t.Fatal(err)
 	}
+	file := buf.Bytes()
 
-	i, err := age.NewScryptIdentity(password)
+	p := &testIdentityProvider{identities: []age.Identity{b, a}}
+	opts := []age.DecryptOption{age.WithIdentityProvider(p)}
+	out, err := age.DecryptWithOptions(bytes.NewReader(file), opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	out, err := age.Decrypt(buf, i)
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+	if p.calls != 1 {
+		t.Errorf("expected provider to be called once, got %d", p.calls)
+	}
+
+	// The provider is not consulted if a static identity matches.
+	if _, err := age.DecryptWithOptions(bytes.NewReader(file), opts, a); err != nil {
+		t.Fatal(err)
+	}
+	if p.calls != 1 {
+		t.Errorf("expected provider not to be called, got %d calls", p.calls)
+	}
+
+	p.identities = []age.Identity{b}
+	_, err = age.DecryptWithOptions(bytes.NewReader(file), opts, b)
+	if e, ok := err.(*age.NoIdentityMatchError); !ok {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	} else if len(e.Errors) != 2 {
+		t.Errorf("expected 2 errors, got %d", len(e.Errors))
+	}
+}
+
+type headerIdentity struct {
+	*age.X25519Identity
+	header []byte
+}
+
+func (i *headerIdentity) UnwrapWithHeader(stanzas []*age.Stanza, header []byte) ([]byte, error) {
+	i.header = append([]byte(nil), header...)
+	return i.Unwrap(stanzas)
+}
+
+func TestIdentityWithHeader(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient(), age.DiscardRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	i := &headerIdentity{X25519Identity: a}
+	if _, err := age.Decrypt(bytes.NewReader(file), i); err != nil {
+		t.Fatal(err)
+	}
+	header, _, ok := bytes.Cut(file, []byte("\n--- "))
+	if !ok {
+		t.Fatal("header MAC line not found")
+	}
+	if expected := string(header) + "\n---"; string(i.header) != expected {
+		t.Errorf("got header %q, expected %q", i.header, expected)
+	}
+}
+
+func TestIdentityFunc(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	var calls int
+	noMatch := age.IdentityFunc(func(stanzas []*age.Stanza) ([]byte, error) {
+		calls++
+		return nil, fmt.Errorf("no luck: %w", age.ErrIncorrectIdentity)
+	})
+	out, err := age.Decrypt(bytes.NewReader(file), noMatch, age.IdentityFunc(a.Unwrap))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -187,100 +398,1793 @@ func TestEncryptDecryptScrypt(t *testing.T) {
 	if string(outBytes) != helloWorld {
 		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
 	}
+	if calls != 1 {
+		t.Errorf("expected function to be called once, got %d", calls)
+	}
+
+	_, err = age.Decrypt(bytes.NewReader(file), noMatch)
+	if e, ok := err.(*age.NoIdentityMatchError); !ok {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	} else if len(e.Errors) != 1 {
+		t.Errorf("expected 1 error, got %d", len(e.Errors))
+	}
+
+	nothing := age.IdentityFunc(func(stanzas []*age.Stanza) ([]byte, error) {
+		return nil, nil
+	})
+	_, err = age.Decrypt(bytes.NewReader(file), nothing, a)
+	if err == nil {
+		t.Error("expected an error for a nil file key without error")
+	} else if _, ok := err.(*age.NoIdentityMatchError); ok {
+		t.Errorf("expected a fatal error, got %v", err)
+	}
 }
 
-func TestParseIdentities(t *testing.T) {
-	tests := []struct {
-		name      string
-		wantCount int
-		wantErr   bool
-		file      string
-	}{
-		{"valid", 2, false, `
-# this is a comment
-# AGE-SECRET-KEY-1705XN76M8EYQ8M9PY4E2G3KA8DN7NSCGT3V4HMN20H3GCX4AS6HSSTG8D3
-#
+func TestRegisterParser(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	age.RegisterRecipientParser("test-recipient:", func(s string) (age.Recipient, error) {
+		return r, nil
+	})
+	age.RegisterIdentityParser("TEST-IDENTITY-", func(s string) (age.Identity, error) {
+		return i, nil
+	})
 
-AGE-SECRET-KEY-1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59QJ
-AGE-SECRET-KEY-19WUMFE89H3928FRJ5U3JYRNHM6CERQGKSQ584AQ8QY7T7R09D32SWE4DYH`},
-		{"invalid", 0, true, `
-AGE-SECRET-KEY-1705XN76M8EYQ8M9PY4E2G3KA8DN7NSCGT3V4HMN20H3GCX4AS6HSSTG8D3
-AGE-SECRET-KEY--1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59Q`},
+	if parse := age.LookupRecipientParser("test-recipient:foo"); parse == nil {
+		t.Error("registered recipient parser not found")
+	} else if got, err := parse("test-recipient:foo"); err != nil || got != r {
+		t.Errorf("unexpected result from recipient parser: %v, %v", got, err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := age.ParseIdentities(strings.NewReader(tt.file))
-			if (err != nil) != tt.wantErr {
-				t.Errorf("ParseIdentities() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if len(got) != tt.wantCount {
-				t.Errorf("ParseIdentities() returned %d identities, want %d", len(got), tt.wantCount)
-			}
-		})
+	if parse := age.LookupIdentityParser("TEST-IDENTITY-FOO"); parse == nil {
+		t.Error("registered identity parser not found")
+	} else if got, err := parse("TEST-IDENTITY-FOO"); err != nil || got != i {
+		t.Errorf("unexpected result from identity parser: %v, %v", got, err)
+	}
+	if age.LookupRecipientParser("test-other:foo") != nil {
+		t.Error("unexpected recipient parser found")
+	}
+	if age.LookupIdentityParser("test-recipient:foo") != nil {
+		t.Error("recipient prefix matched an identity parser")
+	}
+	if types := age.SupportedRecipientTypes(); len(types) != 6 || types[0] != "X25519" || types[5] != "test-recipient:" {
+		t.Errorf("unexpected recipient types: %q", types)
+	}
+	if types := age.SupportedIdentityTypes(); len(types) != 6 || types[0] != "X25519" || types[5] != "TEST-IDENTITY-" {
+		t.Errorf("unexpected identity types: %q", types)
 	}
-}
 
-type testRecipient struct {
-	labels []string
+	for _, prefix := range []string{"", "age1foo", "age", "ssh-foo", "test-recipient:", "test-recipient:foo", "test-"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering recipient prefix %q didn't panic", prefix)
+				}
+			}()
+			age.RegisterRecipientParser(prefix, func(s string) (age.Recipient, error) {
+				return nil, errors.New("unreachable")
+			})
+		}()
+	}
+	for _, prefix := range []string{"AGE-SECRET-KEY-1X", "AGE-", "AGE-PLUGIN-FOO-", "TEST-IDENTITY-"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering identity prefix %q didn't panic", prefix)
+				}
+			}()
+			age.RegisterIdentityParser(prefix, func(s string) (age.Identity, error) {
+				return nil, errors.New("unreachable")
+			})
+		}()
+	}
 }
 
-func (testRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
-	panic("expected WrapWithLabels instead")
-}
+func TestInteractiveChoiceIdentity(t *testing.T) {
+	var ids []*age.X25519Identity
+	for i := 0; i < 3; i++ {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	a, b, c := ids[0], ids[1], ids[2]
 
-func (t testRecipient) WrapWithLabels(fileKey []byte) (s []*age.Stanza, labels []string, err error) {
-	return []*age.Stanza{{Type: "test"}}, t.labels, nil
+	encrypt := func(recipients ...age.Recipient) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, recipients...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var offered []age.Identity
+	chooser := func(matches []age.Identity) (age.Identity, error) {
+		offered = matches
+		return matches[len(matches)-1], nil
+	}
+	id := age.NewInteractiveChoiceIdentity([]age.Identity{c, a, b}, chooser)
+
+	out, err := age.Decrypt(bytes.NewReader(encrypt(a.Recipient(), b.Recipient())), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+	if len(offered) != 2 || offered[0] != a || offered[1] != b {
+		t.Errorf("expected chooser to be offered a and b, got %v", offered)
+	}
+
+	// The chooser is not called if only one candidate matches.
+	offered = nil
+	if _, err := age.Decrypt(bytes.NewReader(encrypt(b.Recipient())), id); err != nil {
+		t.Fatal(err)
+	}
+	if offered != nil {
+		t.Errorf("expected chooser not to be called, got %v", offered)
+	}
+
+	chooserErr := errors.New("user canceled")
+	id = age.NewInteractiveChoiceIdentity([]age.Identity{a, b}, func([]age.Identity) (age.Identity, error) {
+		return nil, chooserErr
+	})
+	if _, err := age.Decrypt(bytes.NewReader(encrypt(a.Recipient(), b.Recipient())), id); !errors.Is(err, chooserErr) {
+		t.Errorf("expected chooser error, got %v", err)
+	}
+
+	if _, err := age.Decrypt(bytes.NewReader(encrypt(c.Recipient())), id); err == nil {
+		t.Errorf("expected no match error")
+	}
 }
 
-func TestLabels(t *testing.T) {
-	scrypt, err := age.NewScryptRecipient("xxx")
+func TestReKey(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
 	if err != nil {
 		t.Fatal(err)
 	}
-	i, err := age.GenerateX25519Identity()
+	b, err := age.GenerateX25519Identity()
 	if err != nil {
 		t.Fatal(err)
 	}
-	x25519 := i.Recipient()
-	pqc := testRecipient{[]string{"postquantum"}}
-	pqcAndFoo := testRecipient{[]string{"postquantum", "foo"}}
-	fooAndPQC := testRecipient{[]string{"foo", "postquantum"}}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-	if _, err := age.Encrypt(io.Discard, scrypt, scrypt); err == nil {
-		t.Error("expected two scrypt recipients to fail")
+	out := &bytes.Buffer{}
+	err = age.ReKey(bytes.NewReader(buf.Bytes()), out, []age.Identity{a}, []age.Recipient{b.Recipient()})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := age.Encrypt(io.Discard, scrypt, x25519); err == nil {
-		t.Error("expected x25519 mixed with scrypt to fail")
+	if _, err := age.Decrypt(bytes.NewReader(out.Bytes()), a); err == nil {
+		t.Errorf("expected old identity to fail")
 	}
-	if _, err := age.Encrypt(io.Discard, x25519, scrypt); err == nil {
-		t.Error("expected x25519 mixed with scrypt to fail")
+	r, err := age.Decrypt(bytes.NewReader(out.Bytes()), b)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := age.Encrypt(io.Discard, pqc, x25519); err == nil {
-		t.Error("expected x25519 mixed with pqc to fail")
+	outBytes, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := age.Encrypt(io.Discard, x25519, pqc); err == nil {
-		t.Error("expected x25519 mixed with pqc to fail")
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
 	}
-	if _, err := age.Encrypt(io.Discard, pqc, pqc); err != nil {
-		t.Errorf("expected two pqc to work, got %v", err)
+
+	out.Reset()
+	err = age.ReKey(bytes.NewReader(buf.Bytes()), out, []age.Identity{b}, []age.Recipient{b.Recipient()})
+	if err == nil {
+		t.Errorf("expected wrong identity to fail")
 	}
-	if _, err := age.Encrypt(io.Discard, pqc); err != nil {
-		t.Errorf("expected one pqc to work, got %v", err)
+	if out.Len() != 0 {
+		t.Errorf("expected no output on decryption failure, got %d bytes", out.Len())
 	}
-	if _, err := age.Encrypt(io.Discard, pqcAndFoo, pqc); err == nil {
-		t.Error("expected pqc+foo mixed with pqc to fail")
+}
+
+func TestSameRecipient(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := age.Encrypt(io.Discard, pqc, pqcAndFoo); err == nil {
-		t.Error("expected pqc+foo mixed with pqc to fail")
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := age.Encrypt(io.Discard, pqc, pqc, pqcAndFoo); err == nil {
-		t.Error("expected pqc+foo mixed with pqc to fail")
+	a1, err := age.ParseX25519Recipient(a.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
 	}
-	if _, err := age.Encrypt(io.Discard, pqcAndFoo, pqcAndFoo); err != nil {
-		t.Errorf("expected two pqc+foo to work, got %v", err)
+	if same, err := age.SameRecipient(a.Recipient(), a1); err != nil || !same {
+		t.Errorf("SameRecipient(a, a) = %v, %v", same, err)
 	}
-	if _, err := age.Encrypt(io.Discard, pqcAndFoo, fooAndPQC); err != nil {
-		t.Errorf("expected pqc+foo mixed with foo+pqc to work, got %v", err)
+	if same, err := age.SameRecipient(a.Recipient(), b.Recipient()); err != nil || same {
+		t.Errorf("SameRecipient(a, b) = %v, %v", same, err)
+	}
+
+	s1, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := age.SameRecipient(s1, s1); err != nil || !same {
+		t.Errorf("SameRecipient(s1, s1) = %v, %v", same, err)
+	}
+	if _, err := age.SameRecipient(s1, s2); err != age.ErrIncomparableRecipients {
+		t.Errorf("SameRecipient(s1, s2) returned %v, want ErrIncomparableRecipients", err)
+	}
+	if same, err := age.SameRecipient(s1, a1); err != nil || same {
+		t.Errorf("SameRecipient(s1, a) = %v, %v", same, err)
+	}
+}
+
+func TestDiscardRecipient(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	if r.String() != i.Recipient().String() {
+		t.Errorf("mismatched test pair: %s, %s", r, i.Recipient())
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r, age.DiscardRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	buf.Reset()
+	w, err = age.Encrypt(buf, age.DiscardRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i); err == nil {
+		t.Error("expected decryption of a discarded file to fail")
+	}
+}
+
+func TestDecryptProgress(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 3*64*1024+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type progressReader interface {
+		io.Reader
+		Progress() (currentChunk, totalChunks int64)
+	}
+	out, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, ok := out.(progressReader)
+	if !ok {
+		t.Fatalf("Decrypt returned %T, which doesn't implement Progress", out)
+	}
+	if current, total := pr.Progress(); current != 0 || total != 4 {
+		t.Errorf("Progress() = %d, %d before reading, expected 0, 4", current, total)
+	}
+	if _, err := io.CopyN(io.Discard, pr, 64*1024+1); err != nil {
+		t.Fatal(err)
+	}
+	if current, total := pr.Progress(); current != 2 || total != 4 {
+		t.Errorf("Progress() = %d, %d, expected 2, 4", current, total)
+	}
+	if _, err := io.Copy(io.Discard, pr); err != nil {
+		t.Fatal(err)
+	}
+	if current, total := pr.Progress(); current != 4 || total != 4 {
+		t.Errorf("Progress() = %d, %d after reading, expected 4, 4", current, total)
+	}
+
+	// The total is unknown without a Size method.
+	out, err = age.Decrypt(bytes.NewBuffer(buf.Bytes()), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, total := out.(progressReader).Progress(); total != -1 {
+		t.Errorf("Progress() returned total %d, expected -1", total)
+	}
+}
+
+func TestStoredFilename(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	encrypt := func(opts ...age.EncryptOption) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, opts, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	withName := encrypt(age.WithFilename("report.pdf"))
+	if bytes.Contains(withName, []byte("report.pdf")) {
+		t.Error("filename stored in plaintext")
+	}
+	var name string
+	out, err := age.DecryptWithOptions(bytes.NewReader(withName),
+		[]age.DecryptOption{age.WithStoredFilename(&name)}, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "report.pdf" {
+		t.Errorf("got filename %q, expected %q", name, "report.pdf")
+	}
+	if outBytes, err := io.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, expected %q", outBytes, helloWorld)
+	}
+
+	// The stanza is ignored if the name is not requested.
+	if _, err := age.Decrypt(bytes.NewReader(withName), i); err != nil {
+		t.Errorf("Decrypt without WithStoredFilename failed: %v", err)
+	}
+
+	name = "stale"
+	if _, err := age.DecryptWithOptions(bytes.NewReader(encrypt()),
+		[]age.DecryptOption{age.WithStoredFilename(&name)}, i); err != nil {
+		t.Fatal(err)
+	}
+	if name != "" {
+		t.Errorf("got filename %q for a file without one", name)
+	}
+
+	for _, name := range []string{"../x", "a/b", `a\b`, ".", "..", strings.Repeat("a", 256)} {
+		if _, err := age.EncryptWithOptions(io.Discard, []age.EncryptOption{age.WithFilename(name)}, r); err == nil {
+			t.Errorf("expected filename %q to be rejected", name)
+		}
+	}
+}
+
+func TestConcatenatedFiles(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	const cs = 64 * 1024
+	var files, plaintexts []byte
+	for n, size := range []int{100, 0, cs, cs + 100, 2 * cs, 10} {
+		plaintext := bytes.Repeat([]byte{byte(n)}, size)
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, buf.Bytes()...)
+		plaintexts = append(plaintexts, plaintext...)
+	}
+
+	opts := []age.DecryptOption{age.WithConcatenatedFiles()}
+	out, err := age.DecryptWithOptions(bytes.NewReader(files), opts, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(outBytes, plaintexts) {
+		t.Errorf("wrong data: got %d bytes, expected %d", len(outBytes), len(plaintexts))
+	}
+
+	out, err = age.Decrypt(bytes.NewReader(files), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(out); err == nil {
+		t.Error("expected Decrypt to reject concatenated files")
+	}
+
+	trailing := append(append([]byte{}, files...), "garbage"...)
+	out, err = age.DecryptWithOptions(bytes.NewReader(trailing), opts, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(out); err == nil {
+		t.Error("expected error for trailing garbage")
+	}
+}
+
+func TestStanzaObserver(t *testing.T) {
+	_, r1 := age.NewTestIdentityRecipientPair()
+	_, r2 := age.NewTestIdentityRecipientPair()
+
+	var indexes []int
+	var observed []*age.Stanza
+	observe := age.WithStanzaObserver(func(i int, s *age.Stanza) {
+		indexes = append(indexes, i)
+		observed = append(observed, &age.Stanza{
+			Type: s.Type, Args: append([]string{}, s.Args...), Body: s.Body,
+		})
+		// The observer must not be able to modify the header.
+		s.Args[0] = "modified"
+	})
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, []age.EncryptOption{observe}, r1, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(indexes, []int{0, 1}) {
+		t.Fatalf("unexpected recipient indexes: %v", indexes)
+	}
+	for i, s := range observed {
+		if s.Type != "X25519" || len(s.Args) != 1 || s.Body != nil {
+			t.Errorf("unexpected stanza %d: %+v", i, s)
+		}
+		if !strings.Contains(buf.String(), "-> X25519 "+s.Args[0]+"\n") {
+			t.Errorf("stanza %d not found in header", i)
+		}
+	}
+	if strings.Contains(buf.String(), "modified") {
+		t.Error("observer could modify the header")
+	}
+}
+
+func TestRequirePostQuantum(t *testing.T) {
+	_, x25519 := age.NewTestIdentityRecipientPair()
+	if _, err := age.RequirePostQuantum(x25519); err == nil {
+		t.Error("expected X25519Recipient to be rejected")
+	}
+
+	scrypt, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.RequirePostQuantum(scrypt); err != nil {
+		t.Errorf("expected ScryptRecipient to be accepted: %v", err)
+	}
+
+	pq := testRecipient{labels: []string{"postquantum"}}
+	recipients, err := age.RequirePostQuantum(pq, pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, recipients...); err != nil {
+		t.Errorf("expected postquantum recipients to work: %v", err)
+	}
+
+	recipients, err = age.RequirePostQuantum(testRecipient{labels: []string{"other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, recipients...); err == nil {
+		t.Error("expected recipient without postquantum label to fail")
+	}
+
+	if _, err := age.RequirePostQuantum(pq, x25519); err == nil {
+		t.Error("expected mixed recipients to be rejected")
+	}
+}
+
+func TestEncryptDecryptScrypt(t *testing.T) {
+	password := "twitch.tv/filosottile"
+
+	r, err := age.NewScryptRecipient(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(15)
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := age.NewScryptIdentity(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestContext(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	chunk := make([]byte, 64*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptContext(ctx, buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 3; j++ {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	out, err := age.DecryptContext(ctx, bytes.NewReader(file), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, total := out.(interface{ Progress() (int64, int64) }).Progress(); total != 3 {
+		t.Errorf("Progress reported %d total chunks, expected 3", total)
+	}
+	if _, err := io.ReadFull(out, chunk); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.ReadAll(out); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Read, got %v", err)
+	}
+	if _, err := w.Write(chunk); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Write, got %v", err)
+	}
+
+	if _, err := age.EncryptContext(ctx, io.Discard, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from EncryptContext, got %v", err)
+	}
+	if _, err := age.DecryptContext(ctx, bytes.NewReader(file), i); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from DecryptContext, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w, err = age.EncryptContext(ctx, io.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(chunk); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := w.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Close, got %v", err)
+	}
+
+	// The context is checked before each identity is tried.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	canceler := age.IdentityFunc(func([]*age.Stanza) ([]byte, error) {
+		cancel()
+		return nil, age.ErrIncorrectIdentity
+	})
+	if _, err := age.DecryptContext(ctx, bytes.NewReader(file), canceler, i); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled after the first identity, got %v", err)
+	}
+}
+
+func TestIncorrectPassphrase(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	wrong, err := age.NewScryptIdentity("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519, _ := age.NewTestIdentityRecipientPair()
+
+	_, err = age.Decrypt(bytes.NewReader(file), wrong, x25519)
+	if e := (*age.NoIdentityMatchError)(nil); !errors.As(err, &e) {
+		t.Fatalf("expected NoIdentityMatchError, got %v", err)
+	} else if len(e.Errors) != 2 || !errors.Is(e.Errors[0], age.ErrIncorrectPassphrase) ||
+		errors.Is(e.Errors[1], age.ErrIncorrectPassphrase) {
+		t.Errorf("expected only the first error to be ErrIncorrectPassphrase, got %v", e.Errors)
+	}
+
+	// A wrong passphrase is not fatal, and the next identity is tried.
+	out, err := age.Decrypt(bytes.NewReader(file), wrong, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outBytes, err := io.ReadAll(out); err != nil {
+		t.Fatal(err)
+	} else if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestConcurrentDecrypt(t *testing.T) {
+	x25519, x25519Recipient := age.NewTestIdentityRecipientPair()
+
+	scryptRecipient, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scryptRecipient.SetWorkFactor(10)
+	scrypt, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		r        age.Recipient
+		identity age.Identity
+	}{
+		{"X25519", x25519Recipient, x25519},
+		{"scrypt", scryptRecipient, scrypt},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testConcurrentDecrypt(t, tt.r, tt.identity)
+		})
+	}
+}
+
+// testConcurrentDecrypt decrypts files encrypted to r from multiple goroutines
+// sharing the same identity. It's most useful with the race detector enabled.
+func testConcurrentDecrypt(t *testing.T, r age.Recipient, identity age.Identity) {
+	const n = 16
+	files := make([][]byte, n)
+	for j := range files {
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fmt.Fprintf(w, "%s %d", helloWorld, j); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files[j] = buf.Bytes()
+	}
+
+	var wg sync.WaitGroup
+	for j := range files {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			out, err := age.Decrypt(bytes.NewReader(files[j]), identity)
+			if err != nil {
+				t.Errorf("file %d: %v", j, err)
+				return
+			}
+			outBytes, err := io.ReadAll(out)
+			if err != nil {
+				t.Errorf("file %d: %v", j, err)
+				return
+			}
+			if exp := fmt.Sprintf("%s %d", helloWorld, j); string(outBytes) != exp {
+				t.Errorf("file %d: wrong data: %q, expected %q", j, outBytes, exp)
+			}
+		}(j)
+	}
+	wg.Wait()
+}
+
+func TestParseIdentities(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantCount int
+		wantErr   bool
+		file      string
+	}{
+		{"valid", 2, false, `
+# this is a comment
+# AGE-SECRET-KEY-1705XN76M8EYQ8M9PY4E2G3KA8DN7NSCGT3V4HMN20H3GCX4AS6HSSTG8D3
+#
+
+AGE-SECRET-KEY-1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59QJ
+AGE-SECRET-KEY-19WUMFE89H3928FRJ5U3JYRNHM6CERQGKSQ584AQ8QY7T7R09D32SWE4DYH`},
+		{"invalid", 0, true, `
+AGE-SECRET-KEY-1705XN76M8EYQ8M9PY4E2G3KA8DN7NSCGT3V4HMN20H3GCX4AS6HSSTG8D3
+AGE-SECRET-KEY--1D6K0SGAX3NU66R4GYFZY0UQWCLM3UUSF3CXLW4KXZM342WQSJ82QKU59Q`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := age.ParseIdentities(strings.NewReader(tt.file))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseIdentities() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.wantCount {
+				t.Errorf("ParseIdentities() returned %d identities, want %d", len(got), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	i, r := age.NewTestIdentityRecipientPair()
+	tests := []struct {
+		name           string
+		wantRecipients int
+		wantIdentities int
+		wantErr        bool
+		file           string
+	}{
+		{"valid", 2, 1, false, `
+# this is a comment
+[recipients]
+` + r.String() + `
+  [ identities ]
+` + i.String() + `
+
+[recipients]
+	` + r.String()},
+		{"only identities", 0, 1, false, "[identities]\n" + i.String()},
+		{"no section", 0, 0, true, r.String()},
+		{"unknown section", 0, 0, true, "[recipients]\n" + r.String() + "\n[plugins]\n"},
+		{"wrong section", 0, 0, true, "[recipients]\n" + i.String()},
+		{"empty", 0, 0, true, "[recipients]\n[identities]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs, ids, err := age.ParseConfig(strings.NewReader(tt.file))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(recs) != tt.wantRecipients {
+				t.Errorf("ParseConfig() returned %d recipients, want %d", len(recs), tt.wantRecipients)
+			}
+			if len(ids) != tt.wantIdentities {
+				t.Errorf("ParseConfig() returned %d identities, want %d", len(ids), tt.wantIdentities)
+			}
+		})
+	}
+
+	// Errors from the sections report line numbers in the whole file.
+	file := "[identities]\n" + i.String() + "\n\n[recipients]\n" + r.String() + "\nage1invalid\n"
+	if _, _, err := age.ParseConfig(strings.NewReader(file)); err == nil {
+		t.Error("ParseConfig() with a malformed recipient: expected an error")
+	} else if !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("ParseConfig() error doesn't name line 6: %v", err)
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	a, _ := age.NewTestIdentityRecipientPair()
+	b, _ := age.NewTestIdentityRecipientPair()
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	contents := "# created: 2021-02-02T13:09:43+01:00\n" + a.String() + "\n\n# second key\n" + b.String() + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := age.LoadIdentityFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.Identities(); len(ids) != 2 {
+		t.Fatalf("expected 2 identities, got %d", len(ids))
+	}
+	c, _ := age.NewTestIdentityRecipientPair()
+	if err := f.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.Remove(func(id age.Identity) bool {
+		return id.(*age.X25519Identity).String() == a.String()
+	}); n != 1 {
+		t.Errorf("expected 1 identity to be removed, got %d", n)
+	}
+	if err := f.Add(age.IdentityFunc(nil)); err == nil {
+		t.Error("expected an error adding an identity without encoding")
+	}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# created: 2021-02-02T13:09:43+01:00\n\n# second key\n" + b.String() + "\n" + c.String() + "\n"
+	if string(got) != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Errorf("permissions not preserved: %v", fi.Mode().Perm())
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("expected only the identity file, got %d entries", len(entries))
+	}
+
+	ids, err := age.ParseIdentities(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 identities after saving, got %d", len(ids))
+	}
+}
+
+func TestWriteRecipientsFile(t *testing.T) {
+	_, r1 := age.NewTestIdentityRecipientPair()
+	_, r2 := age.NewTestIdentityRecipientPair()
+
+	buf := &bytes.Buffer{}
+	if err := age.WriteRecipientsFile(buf, []age.RecipientEntry{
+		{Recipient: r1, Comment: "alice's laptop\n\nbackup key"},
+		{Recipient: r2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.HasPrefix(lines[0], "# created: ") {
+		t.Errorf("missing created comment: %q", lines[0])
+	}
+	if exp := []string{"# alice's laptop", "#", "# backup key", r1.String(), r2.String(), ""}; !reflect.DeepEqual(lines[1:], exp) {
+		t.Errorf("got %q, expected %q", lines[1:], exp)
+	}
+
+	recs, err := age.ParseRecipients(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].(*age.X25519Recipient).String() != r1.String() ||
+		recs[1].(*age.X25519Recipient).String() != r2.String() {
+		t.Errorf("unexpected parsed recipients: %v", recs)
+	}
+
+	if err := age.WriteRecipientsFile(io.Discard, nil); err == nil {
+		t.Error("expected error for empty entries")
+	}
+	if err := age.WriteRecipientsFile(io.Discard, []age.RecipientEntry{
+		{Recipient: testRecipient{}},
+	}); err == nil {
+		t.Error("expected error for recipient without String method")
+	}
+}
+
+type testRecipient struct {
+	labels []string
+}
+
+func (testRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	panic("expected WrapWithLabels instead")
+}
+
+func (t testRecipient) WrapWithLabels(fileKey []byte) (s []*age.Stanza, labels []string, err error) {
+	return []*age.Stanza{{Type: "test"}}, t.labels, nil
+}
+
+func TestLabels(t *testing.T) {
+	scrypt, err := age.NewScryptRecipient("xxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519 := i.Recipient()
+	pqc := testRecipient{[]string{"postquantum"}}
+	pqcAndFoo := testRecipient{[]string{"postquantum", "foo"}}
+	fooAndPQC := testRecipient{[]string{"foo", "postquantum"}}
+
+	if _, err := age.Encrypt(io.Discard, scrypt, scrypt); err == nil {
+		t.Error("expected two scrypt recipients to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, scrypt, x25519); err == nil {
+		t.Error("expected x25519 mixed with scrypt to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, x25519, scrypt); err == nil {
+		t.Error("expected x25519 mixed with scrypt to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, pqc, x25519); err == nil {
+		t.Error("expected x25519 mixed with pqc to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, x25519, pqc); err == nil {
+		t.Error("expected x25519 mixed with pqc to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, pqc, pqc); err != nil {
+		t.Errorf("expected two pqc to work, got %v", err)
+	}
+	if _, err := age.Encrypt(io.Discard, pqc); err != nil {
+		t.Errorf("expected one pqc to work, got %v", err)
+	}
+	if _, err := age.Encrypt(io.Discard, pqcAndFoo, pqc); err == nil {
+		t.Error("expected pqc+foo mixed with pqc to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, pqc, pqcAndFoo); err == nil {
+		t.Error("expected pqc+foo mixed with pqc to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, pqc, pqc, pqcAndFoo); err == nil {
+		t.Error("expected pqc+foo mixed with pqc to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, pqcAndFoo, pqcAndFoo); err != nil {
+		t.Errorf("expected two pqc+foo to work, got %v", err)
+	}
+	if _, err := age.Encrypt(io.Discard, pqcAndFoo, fooAndPQC); err != nil {
+		t.Errorf("expected pqc+foo mixed with foo+pqc to work, got %v", err)
+	}
+	if _, err := age.Encrypt(io.Discard, fooAndPQC, pqcAndFoo); err != nil {
+		t.Errorf("expected foo+pqc mixed with pqc+foo to work, got %v", err)
+	}
+	if fooAndPQC.labels[0] != "foo" || pqcAndFoo.labels[0] != "postquantum" {
+		t.Errorf("recipient labels were modified: %q, %q", fooAndPQC.labels, pqcAndFoo.labels)
+	}
+}
+
+func TestGroupRecipient(t *testing.T) {
+	a, ra := age.NewTestIdentityRecipientPair()
+	b, rb := age.NewTestIdentityRecipientPair()
+	c, rc := age.NewTestIdentityRecipientPair()
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, age.GroupRecipient(ra, rb), rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n-> X25519 "); n != 3 {
+		t.Errorf("expected 3 X25519 stanzas, got %d", n)
+	}
+	for _, i := range []age.Identity{a, b, c} {
+		out, err := age.Decrypt(bytes.NewReader(buf.Bytes()), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outBytes, err := io.ReadAll(out); err != nil {
+			t.Fatal(err)
+		} else if string(outBytes) != helloWorld {
+			t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+		}
+	}
+
+	pqc := testRecipient{[]string{"postquantum"}}
+	if _, err := age.Encrypt(io.Discard, age.GroupRecipient(pqc, ra)); err == nil {
+		t.Error("expected a group mixing pqc and x25519 to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, age.GroupRecipient(ra, rb), pqc); err == nil {
+		t.Error("expected an x25519 group mixed with pqc to fail")
+	}
+	scrypt, err := age.NewScryptRecipient("xxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, age.GroupRecipient(scrypt, ra)); err == nil {
+		t.Error("expected a group mixing scrypt and x25519 to fail")
+	}
+	if _, err := age.Encrypt(io.Discard, age.GroupRecipient()); err == nil {
+		t.Error("expected an empty group to fail")
+	}
+}
+
+// streamAllocs returns the average number of allocations needed to encrypt
+// and decrypt size bytes through a pipe, with fixed 16 KiB reads and writes.
+func streamAllocs(t *testing.T, size int64) float64 {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wbuf, rbuf := make([]byte, 16*1024), make([]byte, 16*1024)
+	errc := make(chan error, 1)
+	return testing.AllocsPerRun(5, func() {
+		pr, pw := io.Pipe()
+		go func() {
+			w, err := age.Encrypt(pw, i.Recipient())
+			if err != nil {
+				errc <- err
+				pw.CloseWithError(err)
+				return
+			}
+			for n := int64(0); n < size; n += int64(len(wbuf)) {
+				if _, err := w.Write(wbuf); err != nil {
+					errc <- err
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			err = w.Close()
+			errc <- err
+			pw.CloseWithError(err)
+		}()
+		r, err := age.Decrypt(pr, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, err := r.Read(rbuf)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDecryptExpectingRecipients(t *testing.T) {
+	a, ra := age.NewTestIdentityRecipientPair()
+	_, rb := age.NewTestIdentityRecipientPair()
+	_, rc := age.NewTestIdentityRecipientPair()
+	_, sshKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshID, err := agessh.NewEd25519Identity(sshKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := sshID.Recipient()
+	_, otherSSHKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSSHID, err := agessh.NewEd25519Identity(otherSSHKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := func(opts []age.EncryptOption, recipients ...age.Recipient) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, opts, recipients...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		file     []byte
+		expected []age.Recipient
+		ok       bool
+	}{
+		{"exact", encrypt(nil, ra, rb, rs), []age.Recipient{rs, ra, rb}, true},
+		{"extra", encrypt(nil, ra, rb, rc), []age.Recipient{ra, rb}, false},
+		{"missing", encrypt(nil, ra, rb), []age.Recipient{ra, rb, rc}, false},
+		{"filename", encrypt([]age.EncryptOption{age.WithFilename("a")}, ra), []age.Recipient{ra}, true},
+		{"wrong SSH key", encrypt(nil, ra, rs), []age.Recipient{ra, otherSSHID.Recipient()}, false},
+		// X25519 stanzas are anonymous.
+		{"anonymous", encrypt(nil, ra, rb), []age.Recipient{ra, rc}, true},
+	} {
+		out, err := age.DecryptExpectingRecipients(bytes.NewReader(tc.file), tc.expected, a)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if outBytes, err := io.ReadAll(out); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if string(outBytes) != helloWorld {
+			t.Errorf("%s: wrong data: %q", tc.name, outBytes)
+		}
+	}
+
+	if _, err := age.DecryptExpectingRecipients(bytes.NewReader(encrypt(nil, ra)),
+		[]age.Recipient{customRecipient{}}, a); err == nil {
+		t.Error("expected an error for an uncheckable recipient type")
+	}
+}
+
+type customRecipient struct{}
+
+func (customRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{{Type: "custom", Body: fileKey}}, nil
+}
+
+func TestMinReaderVersion(t *testing.T) {
+	_, r := age.NewTestIdentityRecipientPair()
+	encrypt := func(opts []age.EncryptOption, recipients ...age.Recipient) error {
+		w, err := age.EncryptWithOptions(io.Discard, opts, recipients...)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	p, err := plugin.New("minversion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		return customRecipient{}, nil
+	})
+	pr, err := plugin.NewRecipient(plugin.EncodeRecipient("minversion", []byte("test")),
+		&plugin.ClientUI{}, plugin.WithInProcess(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"v1.0.0", "1.2.0"} {
+		minVersion := age.WithMinReaderVersion(v)
+		if err := encrypt([]age.EncryptOption{minVersion}, r); err != nil {
+			t.Errorf("%s: X25519 recipient: %v", v, err)
+		}
+		if err := encrypt([]age.EncryptOption{minVersion, age.WithFilename("a.txt")}, r); err != nil {
+			t.Errorf("%s: WithFilename: %v", v, err)
+		}
+	}
+	// Stanza types age doesn't implement need plugin support, added in v1.1.0.
+	for name, recipient := range map[string]age.Recipient{
+		"custom": customRecipient{},
+		"plugin": pr,
+	} {
+		if err := encrypt([]age.EncryptOption{age.WithMinReaderVersion("1.0.0")}, r, recipient); err == nil {
+			t.Errorf("%s recipient: v1.0.0: expected an error", name)
+		} else if !strings.Contains(err.Error(), "recipient #1") {
+			t.Errorf("%s recipient: v1.0.0: error doesn't name the recipient: %v", name, err)
+		}
+		if err := encrypt([]age.EncryptOption{age.WithMinReaderVersion("1.1.0")}, r, recipient); err != nil {
+			t.Errorf("%s recipient: v1.1.0: %v", name, err)
+		}
+	}
+	if err := encrypt([]age.EncryptOption{age.WithMinReaderVersion("0.9.0")}, r); err == nil {
+		t.Error("unknown release: expected an error")
+	}
+}
+
+func TestStreamingMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	small := streamAllocs(t, 1<<20)
+	large := streamAllocs(t, 64<<20)
+	t.Logf("1 MiB: %.0f allocs, 64 MiB: %.0f allocs", small, large)
+	// The steady state should reuse the chunk buffers, so the number of
+	// allocations must not grow with the size of the stream.
+	if large > small+10 {
+		t.Errorf("streaming 64 MiB took %.0f allocations, vs %.0f for 1 MiB", large, small)
+	}
+}
+
+func TestErrNotAnAgeFile(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	armored := armor.NewWriter(buf)
+	w, err := age.Encrypt(armored, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := armored.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, file := range map[string]string{
+		"text":        "hello world\n",
+		"no newline":  "hello",
+		"wrong intro": "age-encryption.org/v2\n-> X25519 foo\n",
+		"armored":     buf.String(),
+	} {
+		_, err := age.Decrypt(strings.NewReader(file), a)
+		if !errors.Is(err, age.ErrNotAnAgeFile) {
+			t.Errorf("%s: expected ErrNotAnAgeFile, got %v", name, err)
+		}
+		if _, err := age.HeaderJSON(strings.NewReader(file)); name != "armored" && !errors.Is(err, age.ErrNotAnAgeFile) {
+			t.Errorf("%s: HeaderJSON: expected ErrNotAnAgeFile, got %v", name, err)
+		}
+	}
+
+	for name, file := range map[string]string{
+		"truncated intro":  "age-encr",
+		"truncated header": "age-encryption.org/v1\n-> X25519",
+	} {
+		_, err := age.Decrypt(strings.NewReader(file), a)
+		if err == nil || errors.Is(err, age.ErrNotAnAgeFile) {
+			t.Errorf("%s: expected a different error, got %v", name, err)
+		}
+	}
+
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := armor.NewReader(strings.NewReader(buf.String()))
+	if _, err := age.Decrypt(r, b); err == nil || errors.Is(err, age.ErrNotAnAgeFile) {
+		t.Errorf("wrong identity: expected NoIdentityMatchError, got %v", err)
+	}
+}
+
+func TestComputeHeaderMAC(t *testing.T) {
+	a, ra := age.NewTestIdentityRecipientPair()
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	var stanzas []*age.Stanza
+	var fileKey []byte
+	capture := age.IdentityFunc(func(s []*age.Stanza) ([]byte, error) {
+		stanzas = s
+		k, err := a.Unwrap(s)
+		fileKey = k
+		return k, err
+	})
+	if _, err := age.Decrypt(bytes.NewReader(file), capture); err != nil {
+		t.Fatal(err)
+	}
+
+	mac, err := age.ComputeHeaderMAC(fileKey, stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rest, ok := bytes.Cut(file, []byte("\n--- "))
+	if !ok {
+		t.Fatal("header MAC line not found")
+	}
+	encodedMAC, _, _ := bytes.Cut(rest, []byte("\n"))
+	if got := base64.RawStdEncoding.EncodeToString(mac); got != string(encodedMAC) {
+		t.Errorf("got MAC %q, expected %q", got, encodedMAC)
+	}
+
+	if _, err := age.ComputeHeaderMAC(fileKey[:15], stanzas); err == nil {
+		t.Error("expected an error for a short file key")
+	}
+}
+
+func TestDecryptWithFileKey(t *testing.T) {
+	a, ra := age.NewTestIdentityRecipientPair()
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	var expected []byte
+	capture := age.IdentityFunc(func(s []*age.Stanza) ([]byte, error) {
+		k, err := a.Unwrap(s)
+		expected = k
+		return k, err
+	})
+	if _, err := age.Decrypt(bytes.NewReader(file), capture); err != nil {
+		t.Fatal(err)
+	}
+
+	r, fileKey, err := age.DecryptWithFileKey(bytes.NewReader(file), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, expected) {
+		t.Errorf("got file key %x, expected %x", fileKey, expected)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", out, helloWorld)
+	}
+
+	b, _ := age.NewTestIdentityRecipientPair()
+	if _, fileKey, err := age.DecryptWithFileKey(bytes.NewReader(file), b); err == nil {
+		t.Error("expected decryption with the wrong identity to fail")
+	} else if fileKey != nil {
+		t.Error("expected no file key on failure")
+	}
+}
+
+func TestDecryptReaderAt(t *testing.T) {
+	a, ra := age.NewTestIdentityRecipientPair()
+	plaintext := make([]byte, 3*64*1024+100)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	r, size, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(plaintext)) {
+		t.Errorf("got size %d, expected %d", size, len(plaintext))
+	}
+
+	var wg sync.WaitGroup
+	for _, off := range []int64{0, 64*1024 - 10, 2*64*1024 + 1, size - 50} {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			out, err := io.ReadAll(io.NewSectionReader(r, off, 100))
+			if err != nil {
+				t.Errorf("offset %d: %v", off, err)
+				return
+			}
+			end := off + 100
+			if end > size {
+				end = size
+			}
+			if !bytes.Equal(out, plaintext[off:end]) {
+				t.Errorf("offset %d: wrong data", off)
+			}
+		}(off)
+	}
+	wg.Wait()
+
+	b, _ := age.NewTestIdentityRecipientPair()
+	if _, _, err := age.DecryptReaderAt(bytes.NewReader(file), int64(len(file)), b); err == nil {
+		t.Error("expected decryption with the wrong identity to fail")
+	} else if _, ok := err.(*age.NoIdentityMatchError); !ok {
+		t.Errorf("expected NoIdentityMatchError, got %v", err)
+	}
+
+	truncated := file[:len(file)-200]
+	if _, _, err := age.DecryptReaderAt(bytes.NewReader(truncated), int64(len(truncated)), a); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+
+	armored := &bytes.Buffer{}
+	aw := armor.NewWriter(armored)
+	if _, err := aw.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := age.DecryptReaderAt(bytes.NewReader(armored.Bytes()), int64(armored.Len()), a); err == nil ||
+		!strings.Contains(err.Error(), "armored") {
+		t.Errorf("expected an error for an armored file, got %v", err)
+	}
+}
+
+func TestDecryptParallel(t *testing.T) {
+	a, ra := age.NewTestIdentityRecipientPair()
+	plaintext := make([]byte, 5*64*1024+100)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	r, err := age.DecryptParallel(bytes.NewReader(file), int64(len(file)), 3, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plaintext) {
+		t.Error("wrong data")
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+
+	b, _ := age.NewTestIdentityRecipientPair()
+	if _, err := age.DecryptParallel(bytes.NewReader(file), int64(len(file)), 3, b); err == nil {
+		t.Error("expected decryption with the wrong identity to fail")
+	}
+
+	truncated := file[:len(file)-200]
+	if _, err := age.DecryptParallel(bytes.NewReader(truncated), int64(len(truncated)), 3, a); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+
+	if _, err := age.DecryptParallel(bytes.NewReader(file), int64(len(file)), 0, a); err == nil {
+		t.Error("expected an error for zero workers")
+	}
+}
+
+func TestHeaderJSON(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	armorWriter := armor.NewWriter(buf)
+	w, err := age.Encrypt(armorWriter, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := armorWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := age.HeaderJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h struct {
+		Armored    bool
+		Recipients []struct {
+			Type    string
+			Args    []string
+			BodyLen int `json:"body_len"`
+		}
+		MAC string
+	}
+	if err := json.Unmarshal(out, &h); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Armored {
+		t.Error("expected armored to be true")
+	}
+	if len(h.Recipients) != 1 || h.Recipients[0].Type != "X25519" ||
+		len(h.Recipients[0].Args) != 1 || h.Recipients[0].BodyLen != 32 {
+		t.Errorf("unexpected recipients: %s", out)
+	}
+	if h.MAC == "" {
+		t.Errorf("missing MAC: %s", out)
+	}
+	if strings.Contains(string(out), "body\"") {
+		t.Errorf("stanza body leaked: %s", out)
+	}
+}
+
+func TestIsEncryptedFile(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !age.IsEncryptedFile(buf.Bytes()) {
+		t.Errorf("binary file not detected")
+	}
+
+	buf.Reset()
+	a := armor.NewWriter(buf)
+	w, err = age.Encrypt(a, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !age.IsEncryptedFile(buf.Bytes()) {
+		t.Errorf("armored file not detected")
+	}
+
+	for _, prefix := range []string{"", "age-encryption.org/v1", "age-encryption.org/v2\n", "hello world\n"} {
+		if age.IsEncryptedFile([]byte(prefix)) {
+			t.Errorf("%q detected as an age file", prefix)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, r := age.NewTestIdentityRecipientPair()
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 70000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	if err := age.Validate(bytes.NewReader(file)); err != nil {
+		t.Errorf("valid file: %v", err)
+	}
+
+	armored := &bytes.Buffer{}
+	aw := armor.NewWriter(armored)
+	if _, err := aw.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := age.Validate(armored); err != nil {
+		t.Errorf("valid armored file: %v", err)
+	}
+
+	// The header ends with "--- ", the 43 bytes of the encoded MAC, and "\n".
+	headerLen := bytes.Index(file, []byte("\n---")) + len("\n--- ") + 43 + 1
+	for name, f := range map[string][]byte{
+		"truncated header": file[:headerLen/2],
+		"truncated nonce":  file[:headerLen+8],
+		"empty payload":    file[:headerLen+16],
+		"truncated chunk":  file[:headerLen+16+64*1024+16+10],
+		"bad intro":        append([]byte("age-encryption.org/v2"), file[21:]...),
+	} {
+		if err := age.Validate(bytes.NewReader(f)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDecryptLimited(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	for _, limit := range []int64{int64(len(helloWorld)), int64(len(helloWorld)) + 1, 1 << 20} {
+		r, err := age.DecryptLimited(bytes.NewReader(file), limit, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("limit %d: %v", limit, err)
+		}
+		if string(out) != helloWorld {
+			t.Errorf("limit %d: wrong data: %q, excepted %q", limit, out, helloWorld)
+		}
+	}
+
+	for _, limit := range []int64{0, int64(len(helloWorld)) - 1} {
+		r, err := age.DecryptLimited(bytes.NewReader(file), limit, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != age.ErrOutputTooLarge {
+			t.Errorf("limit %d: expected ErrOutputTooLarge, got %v", limit, err)
+		}
+		if int64(len(out)) != limit {
+			t.Errorf("limit %d: read %d bytes", limit, len(out))
+		}
+	}
+}
+
+func TestEncryptedSize(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetWorkFactor(10)
+
+	const chunkSize = 64 * 1024
+	for _, recipients := range [][]age.Recipient{
+		{a.Recipient()}, {a.Recipient(), b.Recipient()}, {s},
+	} {
+		for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+			expected, err := age.EncryptedSize(int64(size), recipients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			w, err := age.Encrypt(buf, recipients...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if int64(buf.Len()) != expected {
+				t.Errorf("%d recipients, %d bytes: got size %d, expected %d",
+					len(recipients), size, buf.Len(), expected)
+			}
+		}
+	}
+
+	if _, err := age.EncryptedSize(-1, []age.Recipient{a.Recipient()}); err == nil {
+		t.Error("expected negative size to fail")
+	}
+}
+
+func TestPlaintextSizeFromFileSize(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const chunkSize = 64 * 1024
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, a.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file := buf.Bytes()
+
+		got, err := age.PlaintextSizeFromFileSize(bytes.NewReader(file), int64(len(file)))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if got != int64(size) {
+			t.Errorf("%d bytes: got size %d", size, got)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	// A payload that is shorter than a tag, or that ends with an empty chunk
+	// after a full one, is inconsistent.
+	for _, size := range []int{10, len(file) - 1, len(file) + chunkSize + 16} {
+		if _, err := age.PlaintextSizeFromFileSize(bytes.NewReader(file), int64(size)); err == nil {
+			t.Errorf("expected file size %d to fail", size)
+		}
+	}
+
+	armored := &bytes.Buffer{}
+	aw := armor.NewWriter(armored)
+	aw.Write(buf.Bytes())
+	aw.Close()
+	if _, err := age.PlaintextSizeFromFileSize(armored, int64(armored.Len())); err == nil {
+		t.Error("expected armored file to fail")
 	}
 }
@@ -0,0 +1,57 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package agessh
+
+import (
+	"fmt"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// RecipientFromAgentByComment returns the recipient for the key held by the
+// SSH agent a with the given comment, such as "work laptop".
+//
+// Only the public key is used, so the agent is not asked to perform any
+// private key operations. It's an error if no key or more than one key has the
+// comment, or if the key is not of type "ssh-rsa" or "ssh-ed25519".
+func RecipientFromAgentByComment(a agent.Agent, comment string) (age.Recipient, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list SSH agent keys: %v", err)
+	}
+	var match *agent.Key
+	for _, k := range keys {
+		if k.Comment != comment {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("multiple SSH agent keys with comment %q", comment)
+		}
+		match = k
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no SSH agent key with comment %q", comment)
+	}
+
+	pubKey, err := ssh.ParsePublicKey(match.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH agent key %q: %v", comment, err)
+	}
+	var r age.Recipient
+	switch t := pubKey.Type(); t {
+	case "ssh-rsa":
+		r, err = NewRSARecipient(pubKey)
+	case "ssh-ed25519":
+		r, err = NewEd25519Recipient(pubKey)
+	default:
+		return nil, fmt.Errorf("unsupported SSH agent key type for %q: %q", comment, t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH agent key %q: %v", comment, err)
+	}
+	return r, nil
+}
@@ -14,6 +14,8 @@
 package agessh
 
 import (
+	"bufio"
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
@@ -22,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"filippo.io/age"
 	"filippo.io/age/internal/format"
@@ -85,20 +88,43 @@ func (r *RSARecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 	return []*age.Stanza{l}, nil
 }
 
+// String returns the SSH public key of r in the authorized_keys format, without
+// a comment.
+func (r *RSARecipient) String() string {
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(r.sshKey)), "\n")
+}
+
 type RSAIdentity struct {
-	k      *rsa.PrivateKey
+	k      crypto.Decrypter
+	pubKey *rsa.PublicKey
 	sshKey ssh.PublicKey
 }
 
 var _ age.Identity = &RSAIdentity{}
 
 func NewRSAIdentity(key *rsa.PrivateKey) (*RSAIdentity, error) {
-	s, err := ssh.NewSignerFromKey(key)
+	return NewRSAIdentityFromDecrypter(key)
+}
+
+// NewRSAIdentityFromDecrypter returns a new RSAIdentity that uses key to
+// perform the RSA-OAEP decryption of the file key. key's Public method must
+// return an *rsa.PublicKey, and its Decrypt method must support
+// *rsa.OAEPOptions with SHA-256 and a label.
+//
+// This can be used with keys held on hardware tokens or HSMs, for example
+// through a PKCS#11 library that exposes them as crypto.Decrypter values, so
+// that the private key never leaves the device.
+func NewRSAIdentityFromDecrypter(key crypto.Decrypter) (*RSAIdentity, error) {
+	pub, ok := key.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA key")
+	}
+	sshKey, err := ssh.NewPublicKey(pub)
 	if err != nil {
 		return nil, err
 	}
 	i := &RSAIdentity{
-		k: key, sshKey: s.PublicKey(),
+		k: key, pubKey: pub, sshKey: sshKey,
 	}
 	return i, nil
 }
@@ -106,7 +132,7 @@ func NewRSAIdentity(key *rsa.PrivateKey) (*RSAIdentity, error) {
 func (i *RSAIdentity) Recipient() *RSARecipient {
 	return &RSARecipient{
 		sshKey: i.sshKey,
-		pubKey: &i.k.PublicKey,
+		pubKey: i.pubKey,
 	}
 }
 
@@ -126,8 +152,9 @@ func (i *RSAIdentity) unwrap(block *age.Stanza) ([]byte, error) {
 		return nil, age.ErrIncorrectIdentity
 	}
 
-	fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, i.k,
-		block.Body, []byte(oaepLabel))
+	fileKey, err := i.k.Decrypt(rand.Reader, block.Body, &rsa.OAEPOptions{
+		Hash: crypto.SHA256, Label: []byte(oaepLabel),
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt file key: %v", err)
 	}
@@ -187,6 +214,53 @@ func ParseRecipient(s string) (age.Recipient, error) {
 	return r, nil
 }
 
+// ParseAuthorizedKeys parses an OpenSSH authorized_keys file, and returns a
+// recipient for each supported key in it.
+//
+// Empty lines and lines starting with "#" are ignored, and options prefixes and
+// trailing comments are handled like OpenSSH does. Only "ssh-rsa" and
+// "ssh-ed25519" keys are supported: the types of any other valid keys (such as
+// ECDSA or security key types) are returned in skipped, in order. A line that
+// can't be parsed as a public key is an error.
+func ParseAuthorizedKeys(r io.Reader) (recipients []age.Recipient, skipped []string, err error) {
+	const authorizedKeysSizeLimit = 16 << 20 // 16 MiB
+	const lineLengthLimit = 8 << 10          // 8 KiB, same as sshd(8)
+	scanner := bufio.NewScanner(io.LimitReader(r, authorizedKeysSizeLimit))
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		if len(line) > lineLengthLimit {
+			return nil, nil, fmt.Errorf("line %d is too long", n)
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed SSH public key at line %d: %v", n, err)
+		}
+		var r age.Recipient
+		switch t := pubKey.Type(); t {
+		case "ssh-rsa":
+			r, err = NewRSARecipient(pubKey)
+		case "ssh-ed25519":
+			r, err = NewEd25519Recipient(pubKey)
+		default:
+			skipped = append(skipped, t)
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed SSH public key at line %d: %v", n, err)
+		}
+		recipients = append(recipients, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read authorized keys: %v", err)
+	}
+	return recipients, skipped, nil
+}
+
 func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
 	// See https://blog.filippo.io/using-ed25519-keys-for-encryption and
 	// https://pkg.go.dev/filippo.io/edwards25519#Point.BytesMontgomery.
@@ -245,6 +319,12 @@ func (r *Ed25519Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
 	return []*age.Stanza{l}, nil
 }
 
+// String returns the SSH public key of r in the authorized_keys format, without
+// a comment.
+func (r *Ed25519Recipient) String() string {
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(r.sshKey)), "\n")
+}
+
 type Ed25519Identity struct {
 	secretKey, ourPublicKey []byte
 	sshKey                  ssh.PublicKey
@@ -6,14 +6,25 @@ package agessh_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
+	"filippo.io/age"
 	"filippo.io/age/agessh"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func TestSSHRSARoundTrip(t *testing.T) {
@@ -101,3 +112,387 @@ func TestSSHEd25519RoundTrip(t *testing.T) {
 		t.Errorf("invalid output: %x, expected %x", out, fileKey)
 	}
 }
+
+func TestSameRecipient(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPubKey)))
+
+	a, err := agessh.ParseRecipient(authorizedKey + " alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := agessh.ParseRecipient(authorizedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.(fmt.Stringer).String(); s != authorizedKey {
+		t.Errorf("String() = %q, want %q", s, authorizedKey)
+	}
+	if same, err := age.SameRecipient(a, b); err != nil || !same {
+		t.Errorf("SameRecipient with different comments = %v, %v", same, err)
+	}
+
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshRSAKey, err := ssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := agessh.NewRSARecipient(sshRSAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := age.SameRecipient(a, c); err != nil || same {
+		t.Errorf("SameRecipient with different keys = %v, %v", same, err)
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, err := ssh.NewPublicKey(edPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := ssh.NewPublicKey(&rsaPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := ssh.NewPublicKey(&ecPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedKeys := "# comment\n\n" +
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(edPub))) + " alice@example.com\n" +
+		`no-pty,command="echo hello" ` + string(ssh.MarshalAuthorizedKey(rsaPub)) +
+		"  " + string(ssh.MarshalAuthorizedKey(ecPub))
+
+	recipients, skipped, err := agessh.ParseAuthorizedKeys(strings.NewReader(authorizedKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(recipients))
+	}
+	if _, ok := recipients[0].(*agessh.Ed25519Recipient); !ok {
+		t.Errorf("expected first recipient to be Ed25519, got %T", recipients[0])
+	}
+	if _, ok := recipients[1].(*agessh.RSARecipient); !ok {
+		t.Errorf("expected second recipient to be RSA, got %T", recipients[1])
+	}
+	if !reflect.DeepEqual(skipped, []string{"ecdsa-sha2-nistp256"}) {
+		t.Errorf("unexpected skipped types: %q", skipped)
+	}
+
+	if _, _, err := agessh.ParseAuthorizedKeys(strings.NewReader(authorizedKeys + "ssh-ed25519 AAAA\n")); err == nil {
+		t.Error("expected malformed line to fail")
+	}
+}
+
+// opaqueDecrypter hides the concrete type of an *rsa.PrivateKey, like a
+// hardware-backed crypto.Decrypter would.
+type opaqueDecrypter struct {
+	k *rsa.PrivateKey
+}
+
+func (d opaqueDecrypter) Public() crypto.PublicKey { return d.k.Public() }
+
+func (d opaqueDecrypter) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return d.k.Decrypt(rand, msg, opts)
+}
+
+func TestSSHRSADecrypter(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&pk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := agessh.NewRSARecipient(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := agessh.NewRSAIdentityFromDecrypter(opaqueDecrypter{pk})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(r, i.Recipient()) {
+		t.Fatalf("i.Recipient is different from r")
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agessh.NewRSAIdentityFromDecrypter(edDecrypter{edKey}); err == nil {
+		t.Error("expected non-RSA key to be rejected")
+	}
+}
+
+func TestConcurrentUnwrap(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaIdentity, err := agessh.NewRSAIdentity(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edIdentity, err := agessh.NewEd25519Identity(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemBlock, err := ssh.MarshalPrivateKeyWithPassphrase(edKey, "", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var passphraseCalls int
+	encIdentity, err := agessh.NewEncryptedSSHIdentity(sshPubKey, pem.EncodeToMemory(pemBlock), func() ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		passphraseCalls++
+		return []byte("password"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		r        age.Recipient
+		identity age.Identity
+	}{
+		{"RSA", rsaIdentity.Recipient(), rsaIdentity},
+		{"Ed25519", edIdentity.Recipient(), edIdentity},
+		{"encrypted", encIdentity.Recipient(), encIdentity},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for j := 0; j < 16; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					fileKey := make([]byte, 16)
+					if _, err := rand.Read(fileKey); err != nil {
+						t.Error(err)
+						return
+					}
+					stanzas, err := tt.r.Wrap(fileKey)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					out, err := tt.identity.Unwrap(stanzas)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !bytes.Equal(fileKey, out) {
+						t.Errorf("invalid output: %x, expected %x", out, fileKey)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+
+	if passphraseCalls != 1 {
+		t.Errorf("passphrase requested %d times, expected once", passphraseCalls)
+	}
+}
+
+func TestEncryptedSSHIdentityUnlock(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPubKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrases := []string{"wrong", "password"}
+	i, err := agessh.NewEncryptedSSHIdentity(sshPubKey, pem.EncodeToMemory(pemBlock), func() ([]byte, error) {
+		if len(passphrases) == 0 {
+			t.Fatal("passphrase requested after successful Unlock")
+		}
+		p := passphrases[0]
+		passphrases = passphrases[1:]
+		return []byte(p), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := i.Unlock(); !errors.Is(err, agessh.ErrIncorrectPassphrase) {
+		t.Fatalf("expected ErrIncorrectPassphrase, got %v", err)
+	}
+	if err := i.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stanza for a different key doesn't match, and is not confused with a
+	// wrong passphrase.
+	_, other := age.NewTestIdentityRecipientPair()
+	stanzas, err := other.Wrap(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Unwrap(stanzas); !errors.Is(err, age.ErrIncorrectIdentity) {
+		t.Errorf("expected ErrIncorrectIdentity, got %v", err)
+	}
+
+	r, err := agessh.NewEd25519Recipient(sshPubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err = r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := i.Unwrap(stanzas); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+}
+
+type edDecrypter struct{ ed25519.PrivateKey }
+
+func (edDecrypter) Decrypt(io.Reader, []byte, crypto.DecrypterOpts) ([]byte, error) {
+	panic("unreachable")
+}
+
+func TestRecipientFromAgentByComment(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agent.NewKeyring()
+	for _, k := range []agent.AddedKey{
+		{PrivateKey: rsaKey, Comment: "work laptop"},
+		{PrivateKey: edKey, Comment: "home"},
+		{PrivateKey: ecKey, Comment: "ecdsa"},
+	} {
+		if err := keyring.Add(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rsaID, err := agessh.NewRSAIdentity(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edID, err := agessh.NewEd25519Identity(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for comment, id := range map[string]age.Identity{"work laptop": rsaID, "home": edID} {
+		r, err := agessh.RecipientFromAgentByComment(keyring, comment)
+		if err != nil {
+			t.Fatalf("%s: %v", comment, err)
+		}
+		buf := &bytes.Buffer{}
+		w, err := age.Encrypt(buf, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "hello")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := age.Decrypt(buf, id); err != nil {
+			t.Errorf("%s: %v", comment, err)
+		}
+	}
+
+	for _, comment := range []string{"missing", "ecdsa", "Home"} {
+		if _, err := agessh.RecipientFromAgentByComment(keyring, comment); err == nil {
+			t.Errorf("%s: expected error", comment)
+		}
+	}
+
+	// Comments are not unique, so a second key with the same one is ambiguous.
+	_, edKey2, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: edKey2, Comment: "home"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agessh.RecipientFromAgentByComment(keyring, "home"); err == nil {
+		t.Error("expected ambiguous comment to fail")
+	}
+}
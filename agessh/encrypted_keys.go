@@ -8,7 +8,10 @@ import (
 	"crypto"
 	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"sync"
 
 	"filippo.io/age"
 	"golang.org/x/crypto/ssh"
@@ -27,9 +30,16 @@ type EncryptedSSHIdentity struct {
 	pemBytes   []byte
 	passphrase func() ([]byte, error)
 
+	// mu protects decrypted, and is held while requesting the passphrase, so
+	// that concurrent Unwrap calls don't request it more than once.
+	mu        sync.Mutex
 	decrypted age.Identity
 }
 
+// ErrIncorrectPassphrase is returned, wrapped, by EncryptedSSHIdentity.Unlock
+// and Unwrap if the passphrase doesn't decrypt the private key.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
 // NewEncryptedSSHIdentity returns a new EncryptedSSHIdentity.
 //
 // pubKey must be the public key associated with the encrypted private key, and
@@ -74,9 +84,24 @@ func (i *EncryptedSSHIdentity) Recipient() age.Recipient {
 // Unwrap implements age.Identity. If the private key is still encrypted, and
 // any of the stanzas match the public key, it will request the passphrase. The
 // decrypted private key will be cached after the first successful invocation.
+//
+// Unwrap is safe for concurrent use. Concurrent invocations that need the
+// passphrase wait for the first one to decrypt the private key.
 func (i *EncryptedSSHIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
+	decrypted, err := i.decrypt(stanzas)
+	if err != nil {
+		return nil, err
+	}
+	return decrypted.Unwrap(stanzas)
+}
+
+// decrypt returns the decrypted identity, decrypting the private key first if
+// necessary and if any of the stanzas match the public key.
+func (i *EncryptedSSHIdentity) decrypt(stanzas []*age.Stanza) (age.Identity, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	if i.decrypted != nil {
-		return i.decrypted.Unwrap(stanzas)
+		return i.decrypted, nil
 	}
 
 	var match bool
@@ -97,11 +122,37 @@ func (i *EncryptedSSHIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, er
 		return nil, age.ErrIncorrectIdentity
 	}
 
+	return i.unlock()
+}
+
+// Unlock requests the passphrase and decrypts the private key, without waiting
+// for Unwrap to be called with a matching stanza. This allows applications to
+// tell a wrong passphrase apart from a key that can't decrypt a file.
+//
+// If the passphrase is wrong, Unlock returns an error wrapping
+// ErrIncorrectPassphrase, and it can be called again to retry. If the key is
+// already decrypted, Unlock does nothing.
+func (i *EncryptedSSHIdentity) Unlock() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.decrypted != nil {
+		return nil
+	}
+	_, err := i.unlock()
+	return err
+}
+
+// unlock decrypts the private key and caches it in i.decrypted. It must be
+// called with i.mu held.
+func (i *EncryptedSSHIdentity) unlock() (age.Identity, error) {
 	passphrase, err := i.passphrase()
 	if err != nil {
 		return nil, fmt.Errorf("failed to obtain passphrase: %v", err)
 	}
 	k, err := ssh.ParseRawPrivateKeyWithPassphrase(i.pemBytes, passphrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, fmt.Errorf("failed to decrypt SSH key file: %w", ErrIncorrectPassphrase)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt SSH key file: %v", err)
 	}
@@ -109,16 +160,17 @@ func (i *EncryptedSSHIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, er
 	var pubKey interface {
 		Equal(x crypto.PublicKey) bool
 	}
+	var decrypted age.Identity
 	switch k := k.(type) {
 	case *ed25519.PrivateKey:
-		i.decrypted, err = NewEd25519Identity(*k)
+		decrypted, err = NewEd25519Identity(*k)
 		pubKey = k.Public().(ed25519.PublicKey)
 	// ParseRawPrivateKey returns inconsistent types. See Issue 429.
 	case ed25519.PrivateKey:
-		i.decrypted, err = NewEd25519Identity(k)
+		decrypted, err = NewEd25519Identity(k)
 		pubKey = k.Public().(ed25519.PublicKey)
 	case *rsa.PrivateKey:
-		i.decrypted, err = NewRSAIdentity(k)
+		decrypted, err = NewRSAIdentity(k)
 		pubKey = &k.PublicKey
 	default:
 		return nil, fmt.Errorf("unexpected SSH key type: %T", k)
@@ -131,5 +183,6 @@ func (i *EncryptedSSHIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, er
 		return nil, fmt.Errorf("mismatched private and public SSH key")
 	}
 
-	return i.decrypted.Unwrap(stanzas)
+	i.decrypted = decrypted
+	return decrypted, nil
 }
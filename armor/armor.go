@@ -27,10 +27,23 @@ const (
 
 type armoredWriter struct {
 	started, closed bool
+	noFinalNewline  bool
 	encoder         *format.WrappedBase64Encoder
 	dst             io.Writer
 }
 
+// A WriterOption configures the behavior of NewWriter.
+type WriterOption func(*armoredWriter)
+
+// WithoutTrailingNewline makes the writer omit the newline after the END line,
+// for example when splicing the armored file into a template that manages its
+// own line breaks.
+//
+// NewReader accepts the resulting encoding, but NewStrictReader rejects it.
+func WithoutTrailingNewline() WriterOption {
+	return func(a *armoredWriter) { a.noFinalNewline = true }
+}
+
 func (a *armoredWriter) Write(p []byte) (int, error) {
 	if !a.started {
 		if _, err := io.WriteString(a.dst, Header+"\n"); err != nil {
@@ -50,6 +63,9 @@ func (a *armoredWriter) Close() error {
 		return err
 	}
 	footer := Footer + "\n"
+	if a.noFinalNewline {
+		footer = Footer
+	}
 	if !a.encoder.LastLineIsEmpty() {
 		footer = "\n" + footer
 	}
@@ -57,24 +73,74 @@ func (a *armoredWriter) Close() error {
 	return err
 }
 
-func NewWriter(dst io.Writer) io.WriteCloser {
+func NewWriter(dst io.Writer, opts ...WriterOption) io.WriteCloser {
 	// TODO: write a test with aligned and misaligned sizes, and 8 and 10 steps.
-	return &armoredWriter{
+	a := &armoredWriter{
 		dst:     dst,
 		encoder: format.NewWrappedBase64Encoder(base64.StdEncoding, dst),
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// EncodedSize returns the size of the output of a writer returned by NewWriter
+// with the same options, after writing size bytes and closing it. Together with
+// age.EncryptedSize, it can be used to compute the exact size of an armored age
+// file in advance.
+func EncodedSize(size int64, opts ...WriterOption) int64 {
+	a := &armoredWriter{}
+	for _, opt := range opts {
+		opt(a)
+	}
+	footer := int64(len(Footer) + 1)
+	if a.noFinalNewline {
+		footer--
+	}
+	encoded := (size + 2) / 3 * 4
+	lines := (encoded + format.ColumnsPerLine - 1) / format.ColumnsPerLine
+	return int64(len(Header)+1) + encoded + lines + footer
 }
 
 type armoredReader struct {
 	r       *bufio.Reader
+	strict  bool
 	started bool
+	limit   int64 // maximum decoded size, or -1
+	decoded int64
 	unread  []byte // backed by buf
 	buf     [format.BytesPerLine]byte
 	err     error
 }
 
 func NewReader(r io.Reader) io.Reader {
-	return &armoredReader{r: bufio.NewReader(r)}
+	return &armoredReader{r: bufio.NewReader(r), limit: -1}
+}
+
+// NewReaderLimited is like NewReader, but it returns a *LimitError once the
+// decoded payload exceeds maxBytes, after returning the first maxBytes bytes.
+// maxBytes must not be negative.
+//
+// The reader itself only buffers one line, but this lets applications reject
+// oversized uploads early, before they reach the age decryption layer.
+func NewReaderLimited(r io.Reader, maxBytes int64) io.Reader {
+	if maxBytes < 0 {
+		panic("armor: NewReaderLimited called with negative limit")
+	}
+	return &armoredReader{r: bufio.NewReader(r), limit: maxBytes}
+}
+
+// NewStrictReader is like NewReader, but it only accepts the canonical
+// encoding, as produced by NewWriter: no leading or trailing whitespace or
+// other data, LF line endings, and a newline after the END line.
+//
+// NewReader also rejects non-canonical base64 and incorrect line widths, but
+// tolerates the whitespace variations that are common when armored files are
+// copied around. NewStrictReader is for applications that need the armored
+// encoding of a file to be unique, for example because it's signed or hashed.
+func NewStrictReader(r io.Reader) io.Reader {
+	return &armoredReader{r: bufio.NewReader(r), strict: true, limit: -1}
 }
 
 func (r *armoredReader) Read(p []byte) (int, error) {
@@ -94,6 +160,16 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 		} else if err != nil && err != io.EOF {
 			return nil, err
 		}
+		if r.strict {
+			if err == io.EOF {
+				return nil, errors.New("missing final newline")
+			}
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			if bytes.ContainsRune(line, '\r') {
+				return nil, errors.New("unexpected CR character")
+			}
+			return line, nil
+		}
 		line = bytes.TrimSuffix(line, []byte("\n"))
 		line = bytes.TrimSuffix(line, []byte("\r"))
 		return line, nil
@@ -101,6 +177,14 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 
 	const maxWhitespace = 1024
 	drainTrailing := func() error {
+		if r.strict {
+			if _, err := r.r.ReadByte(); err == nil {
+				return errors.New("trailing data after armored file")
+			} else if err != io.EOF {
+				return err
+			}
+			return io.EOF
+		}
 		buf, err := io.ReadAll(io.LimitReader(r.r, maxWhitespace))
 		if err != nil {
 			return err
@@ -121,7 +205,7 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 			return 0, r.setErr(err)
 		}
 		// Ignore leading whitespace.
-		if len(bytes.TrimSpace(line)) == 0 {
+		if len(bytes.TrimSpace(line)) == 0 && !r.strict {
 			removedWhitespace += len(line) + 1
 			if removedWhitespace > maxWhitespace {
 				return 0, r.setErr(errors.New("too much leading whitespace"))
@@ -143,6 +227,9 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 	if len(line) > format.ColumnsPerLine {
 		return 0, r.setErr(errors.New("column limit exceeded"))
 	}
+	if len(line) == 0 && r.strict {
+		return 0, r.setErr(errors.New("unexpected empty line"))
+	}
 	r.unread = r.buf[:]
 	n, err := base64.StdEncoding.Strict().Decode(r.unread, line)
 	if err != nil {
@@ -150,6 +237,18 @@ func (r *armoredReader) Read(p []byte) (int, error) {
 	}
 	r.unread = r.unread[:n]
 
+	if r.limit >= 0 {
+		r.decoded += int64(n)
+		if over := r.decoded - r.limit; over > 0 {
+			// Not wrapped in an *Error, since it's not a framing issue.
+			r.unread = r.unread[:int64(n)-over]
+			r.err = &LimitError{Limit: r.limit}
+			nn := copy(p, r.unread)
+			r.unread = r.unread[nn:]
+			return nn, nil
+		}
+	}
+
 	if n < format.BytesPerLine {
 		line, err := getLine()
 		if err != nil {
@@ -178,6 +277,16 @@ func (e *Error) Unwrap() error {
 	return e.err
 }
 
+// LimitError is returned by a reader created with NewReaderLimited when the
+// decoded payload exceeds the limit.
+type LimitError struct {
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("armored file exceeds the size limit of %d bytes", e.Limit)
+}
+
 func (r *armoredReader) setErr(err error) error {
 	if err != io.EOF {
 		err = &Error{err}
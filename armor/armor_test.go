@@ -11,6 +11,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -124,8 +125,16 @@ func testArmor(t *testing.T, size int) {
 		t.Error("PEM re-encoded value doesn't match")
 	}
 
+	out, err := io.ReadAll(armor.NewStrictReader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Error("strictly decoded value doesn't match")
+	}
+
 	r := armor.NewReader(buf)
-	out, err := io.ReadAll(r)
+	out, err = io.ReadAll(r)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,6 +143,127 @@ func testArmor(t *testing.T, size int) {
 	}
 }
 
+func TestStrictReader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := armor.NewWriter(buf)
+	if _, err := w.Write(make([]byte, 2*format.BytesPerLine)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	canonical := buf.String()
+
+	for name, file := range map[string]string{
+		"leading whitespace":  "\n" + canonical,
+		"trailing whitespace": canonical + "\n",
+		"trailing data":       canonical + "x",
+		"no final newline":    strings.TrimSuffix(canonical, "\n"),
+		"CRLF":                strings.Replace(canonical, "\n", "\r\n", -1),
+		"empty line":          strings.Replace(canonical, "\n"+armor.Footer, "\n\n"+armor.Footer, 1),
+	} {
+		if _, err := io.ReadAll(armor.NewReader(strings.NewReader(file))); err != nil && name != "trailing data" {
+			t.Errorf("%s: lenient reader failed: %v", name, err)
+		}
+		_, err := io.ReadAll(armor.NewStrictReader(strings.NewReader(file)))
+		if err == nil {
+			t.Errorf("%s: strict reader succeeded", name)
+		} else if _, ok := err.(*armor.Error); !ok {
+			t.Errorf("%s: error type is %T: %v", name, err, err)
+		}
+	}
+}
+
+func TestWithoutTrailingNewline(t *testing.T) {
+	for _, size := range []int{0, 611, 10 * format.BytesPerLine} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		canonical := &bytes.Buffer{}
+		w := armor.NewWriter(canonical)
+		w.Write(plain)
+		w.Close()
+
+		buf := &bytes.Buffer{}
+		w = armor.NewWriter(buf, armor.WithoutTrailingNewline())
+		if _, err := w.Write(plain); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String()+"\n" != canonical.String() {
+			t.Errorf("%d bytes: got %q, expected canonical output without the final newline", size, buf)
+		}
+		out, err := io.ReadAll(armor.NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(out, plain) {
+			t.Errorf("%d bytes: decoded value doesn't match", size)
+		}
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, format.BytesPerLine - 1, format.BytesPerLine,
+		format.BytesPerLine + 1, 10 * format.BytesPerLine, 1000} {
+		for _, opts := range [][]armor.WriterOption{nil, {armor.WithoutTrailingNewline()}} {
+			buf := &bytes.Buffer{}
+			w := armor.NewWriter(buf, opts...)
+			if _, err := w.Write(make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := armor.EncodedSize(int64(size), opts...); got != int64(buf.Len()) {
+				t.Errorf("EncodedSize(%d) with %d options = %d, expected %d", size, len(opts), got, buf.Len())
+			}
+		}
+	}
+}
+
+func TestReaderLimited(t *testing.T) {
+	for _, size := range []int{0, 611, 10 * format.BytesPerLine} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		buf := &bytes.Buffer{}
+		w := armor.NewWriter(buf)
+		w.Write(plain)
+		w.Close()
+
+		for _, limit := range []int{0, size - 1, size, size + 1} {
+			if limit < 0 {
+				continue
+			}
+			out, err := io.ReadAll(armor.NewReaderLimited(bytes.NewReader(buf.Bytes()), int64(limit)))
+			if limit >= size {
+				if err != nil {
+					t.Errorf("%d bytes, limit %d: %v", size, limit, err)
+				} else if !bytes.Equal(out, plain) {
+					t.Errorf("%d bytes, limit %d: decoded value doesn't match", size, limit)
+				}
+				continue
+			}
+			var e *armor.LimitError
+			if !errors.As(err, &e) {
+				t.Errorf("%d bytes, limit %d: expected LimitError, got %v", size, limit, err)
+			} else if e.Limit != int64(limit) {
+				t.Errorf("%d bytes, limit %d: wrong limit in error: %d", size, limit, e.Limit)
+			}
+			var armorErr *armor.Error
+			if errors.As(err, &armorErr) {
+				t.Errorf("%d bytes, limit %d: LimitError is also an armor.Error: %v", size, limit, err)
+			}
+			if !bytes.Equal(out, plain[:limit]) {
+				t.Errorf("%d bytes, limit %d: expected the first %d bytes, got %d", size, limit, limit, len(out))
+			}
+		}
+	}
+}
+
 func FuzzMalleability(f *testing.F) {
 	tests, err := filepath.Glob("../testdata/testkit/*")
 	if err != nil {
@@ -153,6 +283,19 @@ func FuzzMalleability(f *testing.F) {
 		}
 	}
 	f.Fuzz(func(t *testing.T, data []byte) {
+		if content, err := io.ReadAll(armor.NewStrictReader(bytes.NewReader(data))); err == nil {
+			buf := &bytes.Buffer{}
+			w := armor.NewWriter(buf)
+			if _, err := w.Write(content); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Error("strict reader accepted non-canonical input")
+			}
+		}
 		r := armor.NewReader(bytes.NewReader(data))
 		content, err := io.ReadAll(r)
 		if err != nil {
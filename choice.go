@@ -0,0 +1,69 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"errors"
+	"reflect"
+)
+
+type interactiveChoiceIdentity struct {
+	candidates []Identity
+	chooser    func([]Identity) (Identity, error)
+}
+
+// NewInteractiveChoiceIdentity returns an Identity that tries every candidate
+// against the recipient stanzas, and if more than one of them matches, calls
+// chooser with the matching ones (in order) to pick which to use. chooser is
+// not called if a single candidate matches.
+//
+// The returned Identity is meant for interactive tools that want to let the
+// user select a key when several could decrypt a file, for example because it
+// was encrypted to a shared recipient.
+//
+// Note that to determine whether a candidate matches, its Unwrap method must be
+// called, so every candidate is tried even after a match is found. This can be
+// expensive for ScryptIdentity and might involve user interaction for plugins.
+//
+// chooser must return one of the identities it was passed, or an error, which
+// is returned by Unwrap.
+func NewInteractiveChoiceIdentity(candidates []Identity, chooser func([]Identity) (Identity, error)) Identity {
+	return &interactiveChoiceIdentity{candidates: candidates, chooser: chooser}
+}
+
+func (i *interactiveChoiceIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	var matches []Identity
+	var fileKeys [][]byte
+	for _, id := range i.candidates {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, id)
+		fileKeys = append(fileKeys, fileKey)
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, ErrIncorrectIdentity
+	case 1:
+		return fileKeys[0], nil
+	}
+
+	chosen, err := i.chooser(matches)
+	if err != nil {
+		return nil, err
+	}
+	for j, id := range matches {
+		// Comparing interface values with uncomparable dynamic types panics.
+		if reflect.TypeOf(id).Comparable() && id == chosen {
+			return fileKeys[j], nil
+		}
+	}
+	return nil, errors.New("chooser returned an identity that is not a match")
+}
@@ -5,35 +5,44 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
 const usage = `Usage:
-    age-keygen [-o OUTPUT]
-    age-keygen -y [-o OUTPUT] [INPUT]
+    age-keygen [-o OUTPUT] [--comment COMMENT]
+    age-keygen -y [-o OUTPUT] [INPUT...]
 
 Options:
     -o, --output OUTPUT       Write the result to the file at path OUTPUT.
     -y                        Convert an identity file to a recipients file.
+    --comment COMMENT         Add a "# comment:" line to the generated file.
 
 age-keygen generates a new native X25519 key pair, and outputs it to
 standard output or to the OUTPUT file.
 
 If an OUTPUT file is specified, the public key is printed to standard error.
-If OUTPUT already exists, it is not overwritten.
+If OUTPUT already exists, it is not overwritten. OUTPUT is created readable
+only by the current user, and a warning is printed if the secret key is
+written to a file readable by other users.
 
-In -y mode, age-keygen reads an identity file from INPUT or from standard
-input and writes the corresponding recipient(s) to OUTPUT or to standard
-output, one per line, with no comments.
+In -y mode, age-keygen reads one or more identity files from INPUT or from
+standard input and writes the corresponding recipient(s) to OUTPUT or to
+standard output, one per line, with no comments. Native and SSH identities
+are converted, while identities that can't be converted, like plugin ones,
+are skipped with a warning.
 
 Examples:
 
@@ -59,19 +68,23 @@ func main() {
 
 	var (
 		versionFlag, convertFlag bool
-		outFlag                  string
+		outFlag, commentFlag     string
 	)
 
 	flag.BoolVar(&versionFlag, "version", false, "print the version")
 	flag.BoolVar(&convertFlag, "y", false, "convert identities to recipients")
 	flag.StringVar(&outFlag, "o", "", "output to `FILE` (default stdout)")
 	flag.StringVar(&outFlag, "output", "", "output to `FILE` (default stdout)")
+	flag.StringVar(&commentFlag, "comment", "", "add a comment line with `COMMENT`")
 	flag.Parse()
 	if len(flag.Args()) != 0 && !convertFlag {
 		errorf("too many arguments")
 	}
-	if len(flag.Args()) > 1 && convertFlag {
-		errorf("too many arguments")
+	if commentFlag != "" && convertFlag {
+		errorf("--comment can't be used with -y")
+	}
+	if strings.ContainsAny(commentFlag, "\r\n") {
+		errorf("--comment can't contain newlines")
 	}
 	if versionFlag {
 		if Version != "" {
@@ -100,27 +113,35 @@ func main() {
 		out = f
 	}
 
-	in := os.Stdin
-	if inFile := flag.Arg(0); inFile != "" && inFile != "-" {
-		f, err := os.Open(inFile)
-		if err != nil {
-			errorf("failed to open input file %q: %v", inFile, err)
-		}
-		defer f.Close()
-		in = f
-	}
-
 	if convertFlag {
-		convert(in, out)
+		inputs := flag.Args()
+		if len(inputs) == 0 {
+			inputs = []string{"-"}
+		}
+		var n int
+		for _, inFile := range inputs {
+			n += convertFile(inFile, out)
+		}
+		if n == 0 {
+			errorf("no identities found in the input")
+		}
 	} else {
-		if fi, err := out.Stat(); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0004 != 0 {
-			warning("writing secret key to a world-readable file")
+		// The -o file is created with mode 0600, but it might still end up
+		// readable by others because of ACLs or filesystem semantics, and
+		// standard output might be redirected to any file.
+		if fi, err := out.Stat(); err == nil && fi.Mode().IsRegular() {
+			switch perm := fi.Mode().Perm(); {
+			case perm&0004 != 0:
+				warning("writing secret key to a world-readable file")
+			case perm&0040 != 0:
+				warning("writing secret key to a group-readable file")
+			}
 		}
-		generate(out)
+		generate(out, commentFlag)
 	}
 }
 
-func generate(out *os.File) {
+func generate(out *os.File, comment string) {
 	k, err := age.GenerateX25519Identity()
 	if err != nil {
 		errorf("internal error: %v", err)
@@ -131,25 +152,96 @@ func generate(out *os.File) {
 	}
 
 	fmt.Fprintf(out, "# created: %s\n", time.Now().Format(time.RFC3339))
+	if comment != "" {
+		fmt.Fprintf(out, "# comment: %s\n", comment)
+	}
 	fmt.Fprintf(out, "# public key: %s\n", k.Recipient())
 	fmt.Fprintf(out, "%s\n", k)
 }
 
-func convert(in io.Reader, out io.Writer) {
-	ids, err := age.ParseIdentities(in)
+// convertFile writes the recipients corresponding to the identities in the
+// file at name (or standard input if name is "-") to out, and returns how many
+// it converted. Identities that can't be converted are skipped with a warning.
+func convertFile(name string, out io.Writer) int {
+	in := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			errorf("failed to open input file %q: %v", name, err)
+		}
+		defer f.Close()
+		in = f
+	} else {
+		name = "standard input"
+	}
+
+	const maxSize = 16 << 20 // 16 MiB, like age.ParseIdentities
+	data, err := io.ReadAll(io.LimitReader(in, maxSize+1))
 	if err != nil {
-		errorf("failed to parse input: %v", err)
+		errorf("failed to read %q: %v", name, err)
 	}
-	if len(ids) == 0 {
-		errorf("no identities found in the input")
+	if len(data) > maxSize {
+		errorf("failed to read %q: input too large", name)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return convertSSH(name, data, out)
 	}
-	for _, id := range ids {
-		id, ok := id.(*age.X25519Identity)
-		if !ok {
-			errorf("internal error: unexpected identity type: %T", id)
+
+	var n int
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "AGE-PLUGIN-"):
+			warningf("%s: line %d: skipping plugin identity, which can only be converted by the plugin", name, i+1)
+		case strings.HasPrefix(line, "AGE-SECRET-KEY-1"):
+			id, err := age.ParseX25519Identity(line)
+			if err != nil {
+				errorf("%s: line %d: %v", name, i+1, err)
+			}
+			fmt.Fprintf(out, "%s\n", id.Recipient())
+			n++
+		default:
+			errorf("%s: line %d: unknown identity type", name, i+1)
 		}
-		fmt.Fprintf(out, "%s\n", id.Recipient())
 	}
+	return n
+}
+
+// convertSSH writes the recipient corresponding to the SSH private key in data
+// to out, and returns 1, or 0 if the key type is not supported by age.
+// Encrypted keys in the OpenSSH format can be converted without the
+// passphrase, because they include the public key in the clear.
+func convertSSH(name string, data []byte, out io.Writer) int {
+	var pk ssh.PublicKey
+	k, err := ssh.ParseRawPrivateKey(data)
+	if err, ok := err.(*ssh.PassphraseMissingError); ok {
+		if err.PublicKey == nil {
+			warningf("%s: skipping encrypted SSH key without public key, use the .pub file instead", name)
+			return 0
+		}
+		pk = err.PublicKey
+	} else if err != nil {
+		errorf("%s: failed to parse SSH key: %v", name, err)
+	} else {
+		s, err := ssh.NewSignerFromKey(k)
+		if err != nil {
+			warningf("%s: skipping unsupported SSH key: %v", name, err)
+			return 0
+		}
+		pk = s.PublicKey()
+	}
+
+	recipient := ssh.MarshalAuthorizedKey(pk)
+	if _, err := agessh.ParseRecipient(string(recipient)); err != nil {
+		warningf("%s: skipping SSH key: %v", name, err)
+		return 0
+	}
+	out.Write(recipient)
+	return 1
 }
 
 func errorf(format string, v ...interface{}) {
@@ -160,3 +252,7 @@ func errorf(format string, v ...interface{}) {
 func warning(msg string) {
 	log.Printf("age-keygen: warning: %s", msg)
 }
+
+func warningf(format string, v ...interface{}) {
+	log.Printf("age-keygen: warning: "+format, v...)
+}
@@ -7,6 +7,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -26,7 +28,10 @@ import (
 const usage = `Usage:
     age [--encrypt] (-r RECIPIENT | -R PATH)... [--armor] [-o OUTPUT] [INPUT]
     age [--encrypt] --passphrase [--armor] [-o OUTPUT] [INPUT]
-    age --decrypt [-i PATH]... [-o OUTPUT] [INPUT]
+    age --decrypt [-i PATH]... [--multi] [--verify-before-output] [--allow-no-match] [-o OUTPUT] [INPUT]
+    age --inspect [-i PATH]... [INPUT]
+    age --recode [-i PATH]... [--armor] [-o OUTPUT] [INPUT]
+    age --validate FILE...
 
 Options:
     -e, --encrypt               Encrypt the input to the output. Default if omitted.
@@ -37,6 +42,16 @@ Options:
     -r, --recipient RECIPIENT   Encrypt to the specified RECIPIENT. Can be repeated.
     -R, --recipients-file PATH  Encrypt to recipients listed at PATH. Can be repeated.
     -i, --identity PATH         Use the identity file at PATH. Can be repeated.
+    --inspect                   Check if the input can be decrypted, without output.
+    --multi                     Decrypt a sequence of concatenated age files.
+    --verify-before-output      Authenticate the whole input before any output.
+    --allow-no-match            Output nothing and succeed if no identity matches.
+    --recode                    Re-encode the input, armored with -a or else binary.
+    --validate                  Check that each FILE is a well-formed age file.
+    --progress                  Report progress on standard error if it's a terminal.
+    --shred-input               Overwrite and delete INPUT after encrypting it.
+    --store-filename            Store the INPUT file name, encrypted, in the output.
+    --restore-filename          Decrypt to the stored file name in the OUTPUT directory.
 
 INPUT defaults to standard input, and OUTPUT defaults to standard output.
 If OUTPUT exists, it will be overwritten.
@@ -57,6 +72,9 @@ will be ignored. "-" may be used to read identities from standard input.
 When --encrypt is specified explicitly, -i can also be used to encrypt to an
 identity file symmetrically, instead or in addition to normal recipients.
 
+--recode checks the input and copies it, without decrypting the payload. If
+identities are provided, the header is decrypted to authenticate it.
+
 Example:
     $ age-keygen -o key.txt
     Public key: age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
@@ -69,8 +87,19 @@ Example:
 var Version string
 
 // stdinInUse is used to ensure only one of input, recipients, or identities
-// file is read from stdin. It's a singleton like os.Stdin.
-var stdinInUse bool
+// file is read from stdin. It's a singleton like os.Stdin. It's set by
+// claimStdin to the name of the first use, for error messages.
+var stdinInUse string
+
+// claimStdin marks stdin as in use by the named command line argument, or
+// returns an error naming both conflicting uses if it's already in use.
+func claimStdin(use string) error {
+	if stdinInUse != "" {
+		return fmt.Errorf("standard input is used for multiple purposes: %s and %s", stdinInUse, use)
+	}
+	stdinInUse = use
+	return nil
+}
 
 type multiFlag []string
 
@@ -111,12 +140,19 @@ func main() {
 		outFlag                          string
 		decryptFlag, encryptFlag         bool
 		passFlag, versionFlag, armorFlag bool
+		progressFlag, shredInputFlag     bool
+		inspectFlag                      bool
+		storeNameFlag, restoreNameFlag   bool
+		validateFlag, multiFilesFlag     bool
+		verifyFirstFlag, allowNoMatch    bool
+		recodeFlag, listTypesFlag        bool
 		recipientFlags                   multiFlag
 		recipientsFileFlags              multiFlag
 		identityFlags                    identityFlags
 	)
 
 	flag.BoolVar(&versionFlag, "version", false, "print the version")
+	flag.BoolVar(&listTypesFlag, "list-types", false, "print the supported recipient and identity types")
 	flag.BoolVar(&decryptFlag, "d", false, "decrypt the input")
 	flag.BoolVar(&decryptFlag, "decrypt", false, "decrypt the input")
 	flag.BoolVar(&encryptFlag, "e", false, "encrypt the input")
@@ -134,6 +170,16 @@ func main() {
 	flag.Func("i", "identity (can be repeated)", identityFlags.addIdentityFlag)
 	flag.Func("identity", "identity (can be repeated)", identityFlags.addIdentityFlag)
 	flag.Func("j", "data-less plugin (can be repeated)", identityFlags.addPluginFlag)
+	flag.BoolVar(&progressFlag, "progress", false, "report progress on standard error")
+	flag.BoolVar(&shredInputFlag, "shred-input", false, "overwrite and delete the input after encrypting it")
+	flag.BoolVar(&inspectFlag, "inspect", false, "check if the input can be decrypted")
+	flag.BoolVar(&storeNameFlag, "store-filename", false, "store the input file name in the output")
+	flag.BoolVar(&restoreNameFlag, "restore-filename", false, "decrypt to the stored file name in the output directory")
+	flag.BoolVar(&validateFlag, "validate", false, "check that the files are well-formed age files")
+	flag.BoolVar(&multiFilesFlag, "multi", false, "decrypt concatenated age files")
+	flag.BoolVar(&verifyFirstFlag, "verify-before-output", false, "authenticate the whole input before writing any output")
+	flag.BoolVar(&allowNoMatch, "allow-no-match", false, "succeed with empty output if no identity matches")
+	flag.BoolVar(&recodeFlag, "recode", false, "re-encode the input without decrypting the payload")
 	flag.Parse()
 
 	if versionFlag {
@@ -151,6 +197,28 @@ func main() {
 		return
 	}
 
+	if listTypesFlag {
+		printSupportedTypes(os.Stdout)
+		return
+	}
+
+	if validateFlag {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "validate" {
+				return
+			}
+			if len(f.Name) == 1 {
+				errorf("-%s can't be used with --validate", f.Name)
+			}
+			errorf("--%s can't be used with --validate", f.Name)
+		})
+		if flag.NArg() == 0 {
+			errorf("--validate requires at least one FILE")
+		}
+		validateFiles(flag.Args())
+		return
+	}
+
 	if flag.NArg() > 1 {
 		var hints []string
 		quotedArgs := strings.Trim(fmt.Sprintf("%q", flag.Args()), "[]")
@@ -183,7 +251,60 @@ func main() {
 		errorWithHint("too many INPUT arguments: "+quotedArgs, hints...)
 	}
 
+	if recodeFlag {
+		if decryptFlag || encryptFlag {
+			errorf("-e/--encrypt and -d/--decrypt can't be used with --recode")
+		}
+		if inspectFlag {
+			errorf("--inspect can't be used with --recode")
+		}
+		if passFlag {
+			errorWithHint("-p/--passphrase can't be used with --recode",
+				"note that without -i/--identity only the structure of the file is checked")
+		}
+		if len(recipientFlags) > 0 || len(recipientsFileFlags) > 0 {
+			errorWithHint("-r/--recipient and -R/--recipients-file can't be used with --recode",
+				"the recipients of a file can't be changed without decrypting it")
+		}
+		if shredInputFlag {
+			errorf("--shred-input can't be used with --recode")
+		}
+		if storeNameFlag || restoreNameFlag {
+			errorf("--store-filename and --restore-filename can't be used with --recode")
+		}
+		if multiFilesFlag {
+			errorf("--multi can't be used with --recode")
+		}
+		if verifyFirstFlag {
+			errorf("--verify-before-output can't be used with --recode")
+		}
+		if allowNoMatch {
+			errorf("--allow-no-match can't be used with --recode")
+		}
+	}
+
+	if inspectFlag {
+		if outFlag != "" {
+			errorf("-o/--output can't be used with --inspect")
+		}
+		if progressFlag {
+			errorf("--progress can't be used with --inspect")
+		}
+		if multiFilesFlag {
+			errorf("--multi can't be used with --inspect")
+		}
+		if verifyFirstFlag {
+			errorf("--verify-before-output can't be used with --inspect")
+		}
+		if allowNoMatch {
+			errorf("--allow-no-match can't be used with --inspect")
+		}
+		decryptFlag = true
+	}
+
 	switch {
+	case recodeFlag:
+		// Checked above.
 	case decryptFlag:
 		if encryptFlag {
 			errorf("-e/--encrypt can't be used with -d/--decrypt")
@@ -204,6 +325,33 @@ func main() {
 			errorWithHint("-R/--recipients-file can't be used with -d/--decrypt",
 				"did you mean to use -i/--identity to specify a private key?")
 		}
+		if shredInputFlag {
+			errorf("--shred-input can't be used with -d/--decrypt")
+		}
+		if storeNameFlag {
+			errorWithHint("--store-filename can't be used with -d/--decrypt",
+				"did you mean to use --restore-filename?")
+		}
+		if restoreNameFlag && multiFilesFlag {
+			errorf("--restore-filename can't be used with --multi")
+		}
+		if restoreNameFlag && verifyFirstFlag {
+			errorf("--restore-filename can't be used with --verify-before-output")
+		}
+		if allowNoMatch && multiFilesFlag {
+			errorf("--allow-no-match can't be used with --multi")
+		}
+		if allowNoMatch && restoreNameFlag {
+			errorf("--allow-no-match can't be used with --restore-filename")
+		}
+		if restoreNameFlag {
+			if outFlag == "" || outFlag == "-" {
+				errorf("--restore-filename requires -o/--output to be a directory")
+			}
+			if fi, err := os.Stat(outFlag); err != nil || !fi.IsDir() {
+				errorf("--restore-filename requires -o/--output to be a directory, %q is not", outFlag)
+			}
+		}
 	default: // encrypt
 		if len(identityFlags) > 0 && !encryptFlag {
 			errorWithHint("-i/--identity and -j can't be used in encryption mode unless symmetric encryption is explicitly selected with -e/--encrypt",
@@ -222,6 +370,31 @@ func main() {
 		if len(identityFlags) > 0 && passFlag {
 			errorf("-p/--passphrase can't be combined with -i/--identity and -j")
 		}
+		if shredInputFlag && (flag.Arg(0) == "" || flag.Arg(0) == "-") {
+			errorf("--shred-input requires an INPUT file")
+		}
+		if restoreNameFlag {
+			errorWithHint("--restore-filename can't be used in encryption mode",
+				"did you mean to use --store-filename?")
+		}
+		if multiFilesFlag {
+			errorWithHint("--multi can't be used in encryption mode",
+				"did you forget to specify -d/--decrypt?")
+		}
+		if verifyFirstFlag {
+			errorWithHint("--verify-before-output can't be used in encryption mode",
+				"did you forget to specify -d/--decrypt?")
+		}
+		if allowNoMatch {
+			errorWithHint("--allow-no-match can't be used in encryption mode",
+				"did you forget to specify -d/--decrypt?")
+		}
+		if storeNameFlag && passFlag {
+			errorf("--store-filename can't be used with -p/--passphrase")
+		}
+		if storeNameFlag && (flag.Arg(0) == "" || flag.Arg(0) == "-") {
+			errorf("--store-filename requires an INPUT file")
+		}
 	}
 
 	var inUseFiles []string
@@ -237,6 +410,8 @@ func main() {
 
 	var in io.Reader = os.Stdin
 	var out io.Writer = os.Stdout
+	inputSize := int64(-1)
+	outputDone := false
 	if name := flag.Arg(0); name != "" && name != "-" {
 		inUseFiles = append(inUseFiles, absPath(name))
 		f, err := os.Open(name)
@@ -245,9 +420,32 @@ func main() {
 		}
 		defer f.Close()
 		in = f
+		if shredInputFlag {
+			if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+				errorf("--shred-input requires INPUT to be a regular file")
+			}
+			// Deferred functions run in reverse order, so this runs after the
+			// output is closed. outputDone is checked as well because in tests
+			// exit panics, and deferred functions run anyway.
+			defer func() {
+				if !outputDone {
+					return
+				}
+				f.Close()
+				if err := shredFile(name); err != nil {
+					errorf("failed to shred input file %q: %v", name, err)
+				}
+			}()
+		}
+		if progressFlag {
+			if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+				inputSize = fi.Size()
+			}
+		}
 	} else {
-		stdinInUse = true
-		if decryptFlag && term.IsTerminal(int(os.Stdin.Fd())) {
+		// The input is claimed first, so this can't fail.
+		claimStdin("INPUT")
+		if (decryptFlag || recodeFlag) && term.IsTerminal(int(os.Stdin.Fd())) {
 			// If the input comes from a TTY, assume it's armored, and buffer up
 			// to the END line (or EOF/EOT) so that a password prompt or the
 			// output don't get in the way of typing the input. See Issue 364.
@@ -258,7 +456,17 @@ func main() {
 			in = buf
 		}
 	}
-	if name := outFlag; name != "" && name != "-" {
+	if name := outFlag; restoreNameFlag {
+		// The file name is only known after decrypting the header, and
+		// exclusively created by lazyOpener, so it can't overwrite the input.
+		f := newLazyOpenerInDir(name)
+		defer func() {
+			if err := f.Close(); err != nil {
+				errorf("failed to close output file %q: %v", f.name, err)
+			}
+		}()
+		out = f
+	} else if name != "" && name != "-" {
 		for _, f := range inUseFiles {
 			if f == absPath(name) {
 				errorf("input and output file are the same: %q", name)
@@ -266,7 +474,14 @@ func main() {
 		}
 		f := newLazyOpener(name)
 		defer func() {
+			if shredInputFlag {
+				if err := f.Sync(); err != nil {
+					outputDone = false
+					errorf("failed to sync output file %q: %v", name, err)
+				}
+			}
 			if err := f.Close(); err != nil {
+				outputDone = false
 				errorf("failed to close output file %q: %v", name, err)
 			}
 		}()
@@ -292,15 +507,75 @@ func main() {
 		}
 	}
 
+	if verifyFirstFlag {
+		// Hold back the output until decrypt has authenticated the whole
+		// input, in a temporary file next to OUTPUT, or otherwise in memory,
+		// up to maxBufferedOutput.
+		if l, ok := out.(*lazyOpener); ok {
+			l.atomic = true
+		} else {
+			out = &bufferedOutput{dst: out}
+		}
+	}
+	if l, ok := out.(*lazyOpener); ok && recodeFlag {
+		// The payload size is only checked at the end, so don't leave behind
+		// a partial OUTPUT if it's wrong.
+		l.atomic = true
+	}
+
+	if progressFlag && (term.IsTerminal(int(os.Stderr.Fd())) || testOnlyForceProgress) {
+		p := newProgressReader(in, inputSize)
+		defer p.Stop()
+		in = p
+	}
+
+	var inspect *inspectResult
+	if inspectFlag {
+		inspect = &inspectResult{}
+	}
+
+	var encryptOpts []age.EncryptOption
+	if storeNameFlag {
+		encryptOpts = append(encryptOpts, age.WithFilename(filepath.Base(flag.Arg(0))))
+	}
+	var decryptOpts []age.DecryptOption
+	if multiFilesFlag {
+		decryptOpts = append(decryptOpts, age.WithConcatenatedFiles())
+	}
+	noMatchFatal = !allowNoMatch
+
 	switch {
+	case recodeFlag && len(identityFlags) == 0:
+		recode(nil, in, out, armorFlag)
+	case recodeFlag:
+		recode(parseIdentityFlags(identityFlags, nil), in, out, armorFlag)
 	case decryptFlag && len(identityFlags) == 0:
-		decryptPass(in, out)
+		decryptPass(in, out, inspect, decryptOpts)
 	case decryptFlag:
-		decryptNotPass(identityFlags, in, out)
+		decryptNotPass(identityFlags, in, out, inspect, decryptOpts)
 	case passFlag:
 		encryptPass(in, out, armorFlag)
 	default:
-		encryptNotPass(recipientFlags, recipientsFileFlags, identityFlags, in, out, armorFlag)
+		encryptNotPass(recipientFlags, recipientsFileFlags, identityFlags, in, out, armorFlag, encryptOpts)
+	}
+	outputDone = true
+}
+
+// printSupportedTypes prints the recipient and identity types that the CLI
+// supports natively or through parsers registered by this build. Plugins are
+// a single type, and the ones installed are not listed.
+func printSupportedTypes(w io.Writer) {
+	for _, l := range []struct {
+		name  string
+		types []string
+	}{
+		{"recipient", age.SupportedRecipientTypes()},
+		{"identity", age.SupportedIdentityTypes()},
+	} {
+		fmt.Fprintf(w, "%s types:\n", l.name)
+		for _, t := range l.types {
+			fmt.Fprintf(w, "    %s\n", t)
+		}
 	}
 }
 
@@ -332,7 +607,10 @@ func passphrasePromptForEncryption() (string, error) {
 	return p, nil
 }
 
-func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader, out io.Writer, armor bool) {
+const identityAsRecipientHint = "use -i to decrypt with an identity, or convert it to a recipient with age-keygen -y"
+const recipientAsIdentityHint = "use -r or -R to encrypt to a recipient, or provide the private key with -i"
+
+func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader, out io.Writer, armor bool, opts []age.EncryptOption) {
 	var recipients []age.Recipient
 	for _, arg := range recs {
 		r, err := parseRecipient(arg)
@@ -341,6 +619,9 @@ func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader
 				"    curl -O https://github.com/"+err.username+".keys",
 				"    age -R "+err.username+".keys")
 		}
+		if errors.Is(err, identityAsRecipientError{}) {
+			errorWithHint(err.Error(), identityAsRecipientHint)
+		}
 		if err != nil {
 			errorf("%v", err)
 		}
@@ -348,6 +629,9 @@ func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader
 	}
 	for _, name := range files {
 		recs, err := parseRecipientsFile(name)
+		if errors.Is(err, identityAsRecipientError{}) {
+			errorWithHint(fmt.Sprintf("failed to parse recipient file %q: %v", name, err), identityAsRecipientHint)
+		}
 		if err != nil {
 			errorf("failed to parse recipient file %q: %v", name, err)
 		}
@@ -357,6 +641,9 @@ func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader
 		switch f.Type {
 		case "i":
 			ids, err := parseIdentitiesFile(f.Value)
+			if errors.Is(err, recipientAsIdentityError{}) {
+				errorWithHint(fmt.Sprintf("reading %q: %v", f.Value, err), recipientAsIdentityHint)
+			}
 			if err != nil {
 				errorf("reading %q: %v", f.Value, err)
 			}
@@ -373,7 +660,9 @@ func encryptNotPass(recs, files []string, identities identityFlags, in io.Reader
 			recipients = append(recipients, id.Recipient())
 		}
 	}
-	encrypt(recipients, in, out, armor)
+	// Each plugin is executed once, with all of its recipients.
+	recipients = plugin.BatchRecipients(recipients)
+	encrypt(recipients, in, out, armor, opts)
 }
 
 func encryptPass(in io.Reader, out io.Writer, armor bool) {
@@ -387,29 +676,33 @@ func encryptPass(in io.Reader, out io.Writer, armor bool) {
 		errorf("%v", err)
 	}
 	testOnlyConfigureScryptIdentity(r)
-	encrypt([]age.Recipient{r}, in, out, armor)
+	encrypt([]age.Recipient{r}, in, out, armor, nil)
 }
 
 var testOnlyConfigureScryptIdentity = func(*age.ScryptRecipient) {}
 
-func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor bool) {
+func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor bool, opts []age.EncryptOption) {
 	if withArmor {
 		a := armor.NewWriter(out)
 		defer func() {
 			if err := a.Close(); err != nil {
+				exitIfBrokenPipe(err)
 				errorf("%v", err)
 			}
 		}()
 		out = a
 	}
-	w, err := age.Encrypt(out, recipients...)
+	w, err := age.EncryptWithOptions(out, opts, recipients...)
 	if err != nil {
+		exitIfBrokenPipe(err)
 		errorf("%v", err)
 	}
 	if _, err := io.Copy(w, in); err != nil {
+		exitIfBrokenPipe(err)
 		errorf("%v", err)
 	}
 	if err := w.Close(); err != nil {
+		exitIfBrokenPipe(err)
 		errorf("%v", err)
 	}
 }
@@ -420,9 +713,21 @@ func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, withArmor
 const crlfMangledIntro = "age-encryption.org/v1" + "\r"
 const utf16MangledIntro = "\xff\xfe" + "a\x00g\x00e\x00-\x00e\x00n\x00c\x00r\x00y\x00p\x00"
 
+// rejectScryptIdentity is tried first when decrypting with identities. It
+// fails for passphrase-encrypted files, and warns about files that mix an
+// scrypt stanza with other recipients, which age never produces, since anyone
+// who can guess the passphrase can decrypt them.
 type rejectScryptIdentity struct{}
 
 func (rejectScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if len(stanzas) > 1 {
+		for _, s := range stanzas {
+			if s.Type == "scrypt" {
+				warningf("the file is also encrypted with a passphrase, so its security depends on the strength of that passphrase")
+				break
+			}
+		}
+	}
 	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
 		return nil, age.ErrIncorrectIdentity
 	}
@@ -431,40 +736,87 @@ func (rejectScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
 	panic("unreachable")
 }
 
-func decryptNotPass(flags identityFlags, in io.Reader, out io.Writer) {
+func decryptNotPass(flags identityFlags, in io.Reader, out io.Writer, inspect *inspectResult, opts []age.DecryptOption) {
+	decrypt(parseIdentityFlags(flags, inspect), in, out, inspect, opts)
+}
+
+// parseIdentityFlags loads the identities from the -i and -j flags, in order,
+// preceded by rejectScryptIdentity.
+func parseIdentityFlags(flags identityFlags, inspect *inspectResult) []age.Identity {
 	identities := []age.Identity{rejectScryptIdentity{}}
 
+	// The same identity might be listed in multiple files. Trying it again
+	// would be useless, and might spawn plugins or prompt for passphrases.
+	seen := make(map[string]bool)
+	dedupe := func(ids []age.Identity) []age.Identity {
+		var unique []age.Identity
+		for _, id := range ids {
+			if k := identityKey(id); k != "" {
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+			}
+			unique = append(unique, id)
+		}
+		return unique
+	}
+
 	for _, f := range flags {
 		switch f.Type {
 		case "i":
 			ids, err := parseIdentitiesFile(f.Value)
+			if errors.Is(err, recipientAsIdentityError{}) {
+				errorWithHint(fmt.Sprintf("reading %q: %v", f.Value, err), recipientAsIdentityHint)
+			}
 			if err != nil {
 				errorf("reading %q: %v", f.Value, err)
 			}
-			identities = append(identities, ids...)
+			source := fmt.Sprintf("identity file %q", f.Value)
+			identities = append(identities, inspect.wrap(source, dedupe(ids)...)...)
 		case "j":
 			id, err := plugin.NewIdentityWithoutData(f.Value, pluginTerminalUI)
 			if err != nil {
 				errorf("initializing %q: %v", f.Value, err)
 			}
-			identities = append(identities, id)
+			source := fmt.Sprintf("plugin %q", f.Value)
+			identities = append(identities, inspect.wrap(source, dedupe([]age.Identity{id})...)...)
 		}
 	}
-
-	decrypt(identities, in, out)
+	// Each plugin is executed once, with all of its identities. With --inspect
+	// the identities are wrapped, so they're tried one by one to report which
+	// one matched.
+	return plugin.BatchIdentities(identities)
 }
 
-func decryptPass(in io.Reader, out io.Writer) {
-	identities := []age.Identity{
+func decryptPass(in io.Reader, out io.Writer, inspect *inspectResult, opts []age.DecryptOption) {
+	// With --multi, the identity might be invoked once per file, so the
+	// passphrase is only requested the first time.
+	var pass string
+	prompt := func() (string, error) {
+		if pass != "" {
+			return pass, nil
+		}
+		p, err := passphrasePromptForDecryption()
+		pass = p
+		return p, err
+	}
+	identities := inspect.wrap("passphrase",
 		// If there is an scrypt recipient (it will have to be the only one and)
 		// this identity will be invoked.
-		&LazyScryptIdentity{passphrasePromptForDecryption},
-	}
+		&LazyScryptIdentity{prompt},
+	)
 
-	decrypt(identities, in, out)
+	decrypt(identities, in, out, inspect, opts)
 }
 
-func decrypt(identities []age.Identity, in io.Reader, out io.Writer) {
+// noMatchFatal is false if --allow-no-match is set, in which case decrypt
+// produces empty output if none of the identities match.
+var noMatchFatal = true
+
+// decrypt decrypts in to out. If inspect is not nil, it only decrypts the
+// header, and prints to out which identity matched instead of the plaintext.
+func decrypt(identities []age.Identity, in io.Reader, out io.Writer, inspect *inspectResult, opts []age.DecryptOption) {
 	rr := bufio.NewReader(in)
 	if intro, _ := rr.Peek(len(crlfMangledIntro)); string(intro) == crlfMangledIntro ||
 		string(intro) == utf16MangledIntro {
@@ -479,14 +831,71 @@ func decrypt(identities []age.Identity, in io.Reader, out io.Writer) {
 		in = rr
 	}
 
-	r, err := age.Decrypt(in, identities...)
+	var storedName string
+	opts = append(opts, age.WithStoredFilename(&storedName))
+	var r io.Reader
+	r, err := age.DecryptWithOptions(in, opts, identities...)
+	if e := (*age.NoIdentityMatchError)(nil); errors.As(err, &e) && !noMatchFatal {
+		warningf("%v, writing empty output (--allow-no-match)", err)
+		r, err = bytes.NewReader(nil), nil
+	}
+	if errors.Is(err, age.ErrNotAnAgeFile) {
+		errorWithHint(err.Error(), "the input doesn't look like it was encrypted with age")
+	}
 	if err != nil {
 		errorf("%v", err)
 	}
+	if l, ok := out.(*lazyOpener); ok && l.dir != "" {
+		if storedName == "" {
+			errorf("--restore-filename used, but the file has no stored filename")
+		}
+		l.name = filepath.Join(l.dir, storedName)
+	}
+	if inspect != nil {
+		inspect.print(out)
+		return
+	}
 	out.Write(nil) // trigger the lazyOpener even if r is empty
 	if _, err := io.Copy(out, r); err != nil {
+		if l, ok := out.(*lazyOpener); ok {
+			l.discard()
+		}
+		exitIfBrokenPipe(err)
 		errorf("%v", err)
 	}
+	if c, ok := out.(committer); ok {
+		if err := c.commit(); err != nil {
+			errorf("failed to write output: %v", err)
+		}
+	}
+}
+
+// A committer is an output that is held back until commit is called, after
+// the whole input was decrypted and authenticated.
+type committer interface {
+	commit() error
+}
+
+// maxBufferedOutput is the most output that bufferedOutput holds in memory.
+const maxBufferedOutput = 64 << 20
+
+// bufferedOutput is a committer that holds up to maxBufferedOutput bytes of
+// output in memory.
+type bufferedOutput struct {
+	buf bytes.Buffer
+	dst io.Writer
+}
+
+func (b *bufferedOutput) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > maxBufferedOutput {
+		return 0, fmt.Errorf("--verify-before-output can only hold back up to %d MiB of output in memory, use -o to write it to a file", maxBufferedOutput>>20)
+	}
+	return b.buf.Write(p)
+}
+
+func (b *bufferedOutput) commit() error {
+	_, err := b.buf.WriteTo(b.dst)
+	return err
 }
 
 func passphrasePromptForDecryption() (string, error) {
@@ -528,14 +937,34 @@ type lazyOpener struct {
 	name string
 	f    *os.File
 	err  error
+
+	// dir, if not empty, is the directory where the file will be created, and
+	// name is set by decrypt once the stored filename is known. The file must
+	// not exist already.
+	dir string
+
+	// atomic, if set, makes lazyOpener write to a temporary file in the same
+	// directory as name, which is renamed to name by commit, and removed by
+	// discard or Close otherwise. The temporary file is only readable by the
+	// current user until commit gives it the permissions os.Create would have.
+	atomic bool
 }
 
-func newLazyOpener(name string) io.WriteCloser {
+func newLazyOpener(name string) *lazyOpener {
 	return &lazyOpener{name: name}
 }
 
+func newLazyOpenerInDir(dir string) *lazyOpener {
+	return &lazyOpener{dir: dir}
+}
+
 func (l *lazyOpener) Write(p []byte) (n int, err error) {
-	if l.f == nil && l.err == nil {
+	if l.f == nil && l.err == nil && l.dir != "" {
+		l.f, l.err = os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	} else if l.f == nil && l.err == nil && l.atomic {
+		dir, base := filepath.Split(l.name)
+		l.f, l.err = os.CreateTemp(dir, "."+base+".tmp*")
+	} else if l.f == nil && l.err == nil {
 		l.f, l.err = os.Create(l.name)
 	}
 	if l.err != nil {
@@ -544,13 +973,89 @@ func (l *lazyOpener) Write(p []byte) (n int, err error) {
 	return l.f.Write(p)
 }
 
+func (l *lazyOpener) Sync() error {
+	if l.f != nil {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+func (l *lazyOpener) commit() error {
+	if !l.atomic || l.f == nil {
+		return nil
+	}
+	f := l.f
+	l.f = nil
+	if err := f.Chmod(createMode(l.name)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), l.name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// createMode returns the permissions that os.Create would give to name: those
+// of the existing file, or 0666 minus the umask for a new one.
+func createMode(name string) os.FileMode {
+	if fi, err := os.Stat(name); err == nil {
+		return fi.Mode().Perm()
+	}
+	return 0666 &^ umask()
+}
+
+func (l *lazyOpener) discard() {
+	if l.atomic && l.f != nil {
+		l.f.Close()
+		os.Remove(l.f.Name())
+		l.f = nil
+	}
+}
+
 func (l *lazyOpener) Close() error {
+	if l.atomic {
+		// If the output was not committed, it must not be left behind.
+		l.discard()
+		return nil
+	}
 	if l.f != nil {
 		return l.f.Close()
 	}
 	return nil
 }
 
+// shredFile makes a best-effort attempt at overwriting the contents of the file
+// at name with random bytes, and then removes it. It can't guarantee anything
+// on copy-on-write filesystems, SSDs, or if the file was backed up or cached.
+func shredFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, fi.Size()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
 func absPath(name string) string {
 	if abs, err := filepath.Abs(name); err == nil {
 		return abs
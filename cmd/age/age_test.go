@@ -6,7 +6,12 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"syscall"
 	"testing"
 
 	"filippo.io/age"
@@ -26,6 +31,7 @@ func TestMain(m *testing.M) {
 				r.SetWorkFactor(10)
 			}
 			testOnlyFixedRandomWord = "four"
+			testOnlyForceProgress = os.Getenv("AGE_TEST_FORCE_PROGRESS") != ""
 			main()
 			return 0
 		},
@@ -81,3 +87,42 @@ func TestScript(t *testing.T) {
 		// TODO: enable AGEDEBUG=plugin without breaking stderr checks.
 	})
 }
+
+func TestExitIfBrokenPipe(t *testing.T) {
+	testOnlyPanicInsteadOfExit = true
+	t.Cleanup(func() { testOnlyPanicInsteadOfExit = false })
+	exitCode := func(err error) (code int) {
+		testOnlyDidExit = false
+		defer func() {
+			if testOnlyDidExit {
+				code = recover().(int)
+			}
+		}()
+		exitIfBrokenPipe(err)
+		return -1
+	}
+
+	brokenPipe := []error{
+		&os.PathError{Op: "write", Path: "/dev/stdout", Err: syscall.EPIPE},
+		fmt.Errorf("failed to write output: %w", io.ErrClosedPipe),
+	}
+	if runtime.GOOS == "windows" {
+		brokenPipe = append(brokenPipe,
+			&os.PathError{Op: "write", Path: "/dev/stdout", Err: errorBrokenPipe},
+			&os.PathError{Op: "write", Path: "/dev/stdout", Err: errorNoData})
+	}
+	for _, err := range brokenPipe {
+		if code := exitCode(err); code != sigpipeExitCode {
+			t.Errorf("%v: got exit code %d, want %d", err, code, sigpipeExitCode)
+		}
+	}
+
+	for _, err := range []error{
+		&os.PathError{Op: "write", Path: "/dev/stdout", Err: syscall.ENOSPC},
+		errors.New("broken pipe"),
+	} {
+		if code := exitCode(err); code != -1 {
+			t.Errorf("%v: unexpectedly exited with code %d", err, code)
+		}
+	}
+}
@@ -39,12 +39,12 @@ func (i *LazyScryptIdentity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err
 		return nil, err
 	}
 	fileKey, err = ii.Unwrap(stanzas)
-	if errors.Is(err, age.ErrIncorrectIdentity) {
-		// ScryptIdentity returns ErrIncorrectIdentity for an incorrect
-		// passphrase, which would lead Decrypt to returning "no identity
-		// matched any recipient". That makes sense in the API, where there
-		// might be multiple configured ScryptIdentity. Since in cmd/age there
-		// can be only one, return a better error message.
+	if errors.Is(err, age.ErrIncorrectPassphrase) {
+		// ErrIncorrectPassphrase wraps ErrIncorrectIdentity, which would lead
+		// Decrypt to returning "no identity matched any recipient". That makes
+		// sense in the API, where there might be multiple configured
+		// ScryptIdentity. Since in cmd/age there can be only one, return a
+		// better error message.
 		return nil, fmt.Errorf("incorrect passphrase")
 	}
 	return fileKey, err
@@ -0,0 +1,77 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// inspectResult records, in --inspect mode, which identity unwrapped the file
+// key and from which stanza. A nil *inspectResult means --inspect is not set.
+type inspectResult struct {
+	source     string
+	stanza     int // -1 if unknown
+	stanzaType string
+}
+
+// wrap returns ids wrapped so that a successful Unwrap is recorded in r, with
+// source describing where they came from. If r is nil, ids are returned as-is.
+func (r *inspectResult) wrap(source string, ids ...age.Identity) []age.Identity {
+	if r == nil {
+		return ids
+	}
+	var wrapped []age.Identity
+	for _, id := range ids {
+		wrapped = append(wrapped, &inspectIdentity{id: id, source: source, result: r})
+	}
+	return wrapped
+}
+
+func (r *inspectResult) print(w io.Writer) {
+	if r.stanza < 0 {
+		fmt.Fprintf(w, "file can be decrypted with %s\n", r.source)
+		return
+	}
+	fmt.Fprintf(w, "file can be decrypted with %s (stanza %d, %s)\n", r.source, r.stanza, r.stanzaType)
+}
+
+type inspectIdentity struct {
+	id     age.Identity
+	source string
+	result *inspectResult
+}
+
+func (i *inspectIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	fileKey, err := i.id.Unwrap(stanzas)
+	if err != nil {
+		return nil, err
+	}
+	*i.result = inspectResult{source: i.source, stanza: -1}
+
+	// Find the matching stanza by trying them one by one, but only for
+	// identities that are cheap and never interactive. Encrypted keys and
+	// plugins might prompt the user again, or produce warnings.
+	switch i.id.(type) {
+	case *age.X25519Identity, *agessh.RSAIdentity, *agessh.Ed25519Identity:
+	default:
+		return fileKey, nil
+	}
+	for n, s := range stanzas {
+		_, err := i.id.Unwrap([]*age.Stanza{s})
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		}
+		if err == nil {
+			i.result.stanza, i.result.stanzaType = n, s.Type
+		}
+		break
+	}
+	return fileKey, nil
+}
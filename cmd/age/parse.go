@@ -7,6 +7,7 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -28,7 +29,52 @@ func (gitHubRecipientError) Error() string {
 	return `"github:" recipients were removed from the design`
 }
 
+// identityAsRecipientError is returned when a recipient looks like an
+// identity, a common mistake. It doesn't include the value, which is secret.
+type identityAsRecipientError struct{}
+
+func (identityAsRecipientError) Error() string {
+	return "the recipient looks like an identity (private key)"
+}
+
+// recipientAsIdentityError is returned when an identity looks like a
+// recipient, a common mistake.
+type recipientAsIdentityError struct{}
+
+func (recipientAsIdentityError) Error() string {
+	return "the identity looks like a recipient (public key)"
+}
+
+// looksLikeRecipient reports whether s looks like a native, plugin, or SSH
+// recipient, including unsupported SSH key types.
+func looksLikeRecipient(s string) bool {
+	_, isSSH := sshKeyType(s)
+	return strings.HasPrefix(s, "age1") || strings.HasPrefix(s, "ssh-") || isSSH
+}
+
+// parseRecipient parses a recipient string, which may be followed by a comment
+// like "age1... # alice". Errors mention the comment, if present.
 func parseRecipient(arg string) (age.Recipient, error) {
+	arg, comment := cutRecipientComment(arg)
+	r, err := parseRecipientWithoutComment(arg)
+	if _, ok := err.(gitHubRecipientError); err != nil && !ok && comment != "" {
+		return nil, fmt.Errorf("%w (recipient %q)", err, comment)
+	}
+	return r, err
+}
+
+// cutRecipientComment splits a trailing comment, introduced by whitespace
+// and "#", from a recipient string.
+func cutRecipientComment(arg string) (recipient, comment string) {
+	for i := 1; i < len(arg); i++ {
+		if arg[i] == '#' && (arg[i-1] == ' ' || arg[i-1] == '\t') {
+			return strings.TrimSpace(arg[:i]), strings.TrimSpace(arg[i+1:])
+		}
+	}
+	return arg, ""
+}
+
+func parseRecipientWithoutComment(arg string) (age.Recipient, error) {
 	switch {
 	case strings.HasPrefix(arg, "age1") && strings.Count(arg, "1") > 1:
 		return plugin.NewRecipient(arg, pluginTerminalUI)
@@ -39,6 +85,12 @@ func parseRecipient(arg string) (age.Recipient, error) {
 	case strings.HasPrefix(arg, "github:"):
 		name := strings.TrimPrefix(arg, "github:")
 		return nil, gitHubRecipientError{name}
+	case strings.HasPrefix(arg, "AGE-SECRET-KEY-1"), strings.HasPrefix(arg, "AGE-PLUGIN-"),
+		strings.HasPrefix(arg, "-----BEGIN"):
+		return nil, identityAsRecipientError{}
+	}
+	if parse := age.LookupRecipientParser(arg); parse != nil {
+		return parse(arg)
 	}
 
 	return nil, fmt.Errorf("unknown recipient type: %q", arg)
@@ -47,10 +99,9 @@ func parseRecipient(arg string) (age.Recipient, error) {
 func parseRecipientsFile(name string) ([]age.Recipient, error) {
 	var f *os.File
 	if name == "-" {
-		if stdinInUse {
-			return nil, fmt.Errorf("standard input is used for multiple purposes")
+		if err := claimStdin("-R -"); err != nil {
+			return nil, err
 		}
-		stdinInUse = true
 		f = os.Stdin
 	} else {
 		var err error
@@ -77,6 +128,9 @@ func parseRecipientsFile(name string) ([]age.Recipient, error) {
 		}
 		r, err := parseRecipient(line)
 		if err != nil {
+			if errors.Is(err, identityAsRecipientError{}) {
+				return nil, fmt.Errorf("%q: line %d: %w", name, n, err)
+			}
 			if t, ok := sshKeyType(line); ok {
 				// Skip unsupported but valid SSH public keys with a warning.
 				warningf("recipients file %q: ignoring unsupported SSH key of type %q at line %d", name, t, n)
@@ -126,15 +180,16 @@ func sshKeyType(s string) (string, bool) {
 func parseIdentitiesFile(name string) ([]age.Identity, error) {
 	var f *os.File
 	if name == "-" {
-		if stdinInUse {
-			return nil, fmt.Errorf("standard input is used for multiple purposes")
+		if err := claimStdin("-i -"); err != nil {
+			return nil, err
 		}
-		stdinInUse = true
 		f = os.Stdin
 	} else {
 		var err error
 		f, err = os.Open(name)
-		if err != nil {
+		if err != nil && looksLikeRecipient(name) {
+			return nil, recipientAsIdentityError{}
+		} else if err != nil {
 			return nil, fmt.Errorf("failed to open file: %v", err)
 		}
 		defer f.Close()
@@ -188,8 +243,10 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 	// An unencrypted age identity file.
 	default:
 		ids, err := parseIdentities(b)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read %q: %v", name, err)
+		if err != nil && strings.HasSuffix(name, ".pub") {
+			return nil, fmt.Errorf("failed to read %q: %w", name, recipientAsIdentityError{})
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %w", name, err)
 		}
 		return ids, nil
 	}
@@ -201,6 +258,10 @@ func parseIdentity(s string) (age.Identity, error) {
 		return plugin.NewIdentity(s, pluginTerminalUI)
 	case strings.HasPrefix(s, "AGE-SECRET-KEY-1"):
 		return age.ParseX25519Identity(s)
+	case looksLikeRecipient(s):
+		return nil, recipientAsIdentityError{}
+	case age.LookupIdentityParser(s) != nil:
+		return age.LookupIdentityParser(s)(s)
 	default:
 		return nil, fmt.Errorf("unknown identity type")
 	}
@@ -221,7 +282,7 @@ func parseIdentities(f io.Reader) ([]age.Identity, error) {
 
 		i, err := parseIdentity(line)
 		if err != nil {
-			return nil, fmt.Errorf("error at line %d: %v", n, err)
+			return nil, fmt.Errorf("error at line %d: %w", n, err)
 		}
 		ids = append(ids, i)
 
@@ -265,6 +326,27 @@ func parseSSHIdentity(name string, pemBytes []byte) ([]age.Identity, error) {
 	return []age.Identity{id}, nil
 }
 
+// identityKey returns a string that is the same for identities known to be
+// equivalent, or an empty string if id can't be compared.
+func identityKey(id age.Identity) string {
+	switch id := id.(type) {
+	case *age.X25519Identity:
+		return id.String()
+	case *plugin.Identity:
+		return id.String()
+	case *agessh.RSAIdentity:
+		return id.Recipient().String()
+	case *agessh.Ed25519Identity:
+		return id.Recipient().String()
+	case *agessh.EncryptedSSHIdentity:
+		return "encrypted " + fmt.Sprint(id.Recipient())
+	case *EncryptedIdentity:
+		return "encrypted " + string(id.Contents)
+	default:
+		return ""
+	}
+}
+
 func readPubFile(name string) (ssh.PublicKey, error) {
 	if name == "-" {
 		return nil, fmt.Errorf(`failed to obtain public key for "-" SSH key
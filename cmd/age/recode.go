@@ -0,0 +1,73 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// recode copies the age file read from in to out, armored if withArmor is set
+// and binary otherwise, without decrypting the payload. If identities is not
+// empty, the header is decrypted to check the header MAC, otherwise only the
+// structure of the file is checked. In both cases the payload size is checked,
+// but the payload can only be authenticated by decrypting it.
+func recode(identities []age.Identity, in io.Reader, out io.Writer, withArmor bool) {
+	rr := bufio.NewReader(in)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		in = armor.NewReader(rr)
+	} else {
+		in = rr
+	}
+
+	// Whatever is read while checking the header is saved, to be written out
+	// before the rest of the input.
+	header := &bytes.Buffer{}
+	tee := io.TeeReader(in, header)
+	var err error
+	if len(identities) > 0 {
+		_, err = age.Decrypt(tee, identities...)
+	} else {
+		_, err = age.HeaderJSON(tee)
+	}
+	if errors.Is(err, age.ErrNotAnAgeFile) {
+		errorWithHint(err.Error(), "the input doesn't look like it was encrypted with age")
+	}
+	if err != nil {
+		errorf("%v", err)
+	}
+	start := header.Bytes()
+
+	dst := out
+	var a io.WriteCloser
+	if withArmor {
+		a = armor.NewWriter(out)
+		out = a
+	}
+	n, err := io.Copy(out, io.MultiReader(bytes.NewReader(start), in))
+	if err != nil {
+		exitIfBrokenPipe(err)
+		errorf("%v", err)
+	}
+	if _, err := age.PlaintextSizeFromFileSize(bytes.NewReader(start), n); err != nil {
+		errorf("%v", err)
+	}
+	if a != nil {
+		if err := a.Close(); err != nil {
+			exitIfBrokenPipe(err)
+			errorf("%v", err)
+		}
+	}
+	if c, ok := dst.(committer); ok {
+		if err := c.commit(); err != nil {
+			errorf("failed to write output: %v", err)
+		}
+	}
+}
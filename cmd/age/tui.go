@@ -21,6 +21,10 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"filippo.io/age/armor"
 	"filippo.io/age/plugin"
@@ -67,6 +71,32 @@ func exit(code int) {
 	os.Exit(code)
 }
 
+// Windows system error codes returned when writing to a pipe that was closed
+// on the other end. Package syscall only defines the first one, and only on
+// Windows, so they are spelled out here.
+const (
+	errorBrokenPipe syscall.Errno = 109 // ERROR_BROKEN_PIPE
+	errorNoData     syscall.Errno = 232 // ERROR_NO_DATA
+)
+
+// sigpipeExitCode is the exit status of a process killed by SIGPIPE (signal
+// 13) in Unix shells. syscall.SIGPIPE is not defined on all platforms.
+const sigpipeExitCode = 128 + 13
+
+// exitIfBrokenPipe exits quietly if err comes from writing to a pipe that was
+// closed on the other end, for example by "age -d file.age | head". On Unix,
+// the Go runtime usually kills the process with SIGPIPE before the write error
+// is returned, but Windows doesn't have SIGPIPE, and the error would otherwise
+// be reported as an unexpected failure.
+func exitIfBrokenPipe(err error) {
+	var errno syscall.Errno
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe) ||
+		runtime.GOOS == "windows" && errors.As(err, &errno) &&
+			(errno == errorBrokenPipe || errno == errorNoData) {
+		exit(sigpipeExitCode)
+	}
+}
+
 // clearLine clears the current line on the terminal, or opens a new line if
 // terminal escape codes don't work.
 func clearLine(out io.Writer) {
@@ -86,10 +116,18 @@ func clearLine(out io.Writer) {
 	fmt.Fprintf(out, "\r\n"+CPL+EL)
 }
 
+// terminalMu is held while withTerminal interacts with the user, so that
+// progress reports don't draw over a prompt and what the user is typing.
+var terminalMu sync.Mutex
+
 // withTerminal runs f with the terminal input and output files, if available.
 // withTerminal does not open a non-terminal stdin, so the caller does not need
 // to check stdinInUse.
 func withTerminal(f func(in, out *os.File) error) error {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	clearProgress()
+
 	if runtime.GOOS == "windows" {
 		in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
 		if err != nil {
@@ -224,3 +262,101 @@ func bufferTerminalInput(in io.Reader) (io.Reader, error) {
 type ReaderFunc func(p []byte) (n int, err error)
 
 func (f ReaderFunc) Read(p []byte) (n int, err error) { return f(p) }
+
+// progressReader counts the bytes read from r, and reports them to standard
+// error every second until Stop is called. If total is not negative, it's used
+// to report a percentage.
+type progressReader struct {
+	r     io.Reader
+	total int64
+	n     atomic.Int64
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// testOnlyForceProgress makes --progress report to standard error even if
+// it's not a terminal.
+var testOnlyForceProgress bool
+
+func newProgressReader(r io.Reader, total int64) *progressReader {
+	p := &progressReader{r: r, total: total, stop: make(chan struct{})}
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				// Skip the report if a prompt is open.
+				if terminalMu.TryLock() {
+					p.print()
+					terminalMu.Unlock()
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
+
+// progressShown is set while a progress report is on the current line of
+// standard error. It's protected by terminalMu.
+var progressShown bool
+
+// print draws the progress report. It must be called with terminalMu held.
+func (p *progressReader) print() {
+	n := p.n.Load()
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r"+eraseLine+"age: %s of %s (%d%%)", formatSize(n), formatSize(p.total), n*100/p.total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r"+eraseLine+"age: %s", formatSize(n))
+	}
+	progressShown = true
+}
+
+// clearProgress erases the progress report, if any, before a prompt. The next
+// report draws it again. It must be called with terminalMu held.
+func clearProgress() {
+	if progressShown {
+		fmt.Fprintf(os.Stderr, "\r"+eraseLine)
+		progressShown = false
+	}
+}
+
+const eraseLine = "\033[K"
+
+// Stop stops the progress reports. If any were printed, it prints a final one
+// and ends the line.
+func (p *progressReader) Stop() {
+	close(p.stop)
+	p.done.Wait()
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+	if p.n.Load() > 0 {
+		p.print()
+		fmt.Fprintf(os.Stderr, "\n")
+		progressShown = false
+	}
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
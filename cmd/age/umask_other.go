@@ -0,0 +1,15 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// umask returns the file mode creation mask of the process, which is only
+// meaningful on Unix.
+func umask() fs.FileMode {
+	return 0
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// validateFiles checks that each of the named files is a well-formed age file,
+// without decrypting it, and exits at the first one that isn't.
+func validateFiles(names []string) {
+	for _, name := range names {
+		if name == "-" {
+			validateFile(name, os.Stdin)
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			errorf("failed to open input file %q: %v", name, err)
+		}
+		validateFile(name, f)
+		f.Close()
+	}
+}
+
+func validateFile(name string, in io.Reader) {
+	if err := age.Validate(in); err != nil {
+		errorf("%q is not a valid age file: %v", name, err)
+	}
+}
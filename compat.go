@@ -0,0 +1,49 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+// releases are the age releases known to WithMinReaderVersion, in order.
+var releases = []string{"1.0.0", "1.1.0", "1.2.0"}
+
+// firstReaderRelease maps the stanza types natively supported by age to the
+// first release that can decrypt them. Types not listed can only be decrypted
+// through plugins.
+var firstReaderRelease = map[string]string{
+	"X25519":      "1.0.0",
+	"scrypt":      "1.0.0",
+	"ssh-rsa":     "1.0.0",
+	"ssh-ed25519": "1.0.0",
+}
+
+// pluginReaderRelease is the first release that can decrypt stanzas through
+// plugins, and so the first that can read stanza types it doesn't implement.
+const pluginReaderRelease = "1.1.0"
+
+func knownRelease(version string) bool {
+	for _, r := range releases {
+		if r == version {
+			return true
+		}
+	}
+	return false
+}
+
+// readerSupports reports whether the known release version can decrypt files
+// with stanzas of the given type.
+func readerSupports(version, stanzaType string) bool {
+	first, ok := firstReaderRelease[stanzaType]
+	if !ok {
+		first = pluginReaderRelease
+	}
+	for _, r := range releases {
+		if r == first {
+			return true
+		}
+		if r == version {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"context"
+	"io"
+)
+
+// EncryptContext is like Encrypt, but once ctx is done, Write and Close on the
+// returned WriteCloser, as well as any write to dst, fail with ctx.Err(). This
+// can be used to stop encrypting a large stream, for example if the client it
+// comes from disconnects. The output is then truncated, and won't decrypt.
+//
+// The context is checked before the file key is wrapped for each recipient, but
+// a recipient that is already running is not interrupted. ScryptRecipient might
+// take a while, and plugins might wait for user interaction. To stop a plugin,
+// construct it with plugin.WithContext and the same context.
+func EncryptContext(ctx context.Context, dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	withCtx := func(o *encryptOptions) { o.ctx = ctx }
+	w, err := EncryptWithOptions(&ctxWriter{ctx: ctx, w: dst}, []EncryptOption{withCtx}, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	return &ctxWriteCloser{ctxWriter{ctx: ctx, w: w}, w}, nil
+}
+
+// DecryptContext is like Decrypt, but once ctx is done, Read on the returned
+// Reader fails with ctx.Err(), and so does any further read from src.
+//
+// Like for EncryptContext, the context is checked before each identity is tried,
+// but an identity that is already running is not interrupted, unless it's a
+// plugin constructed with plugin.WithContext and the same context.
+func DecryptContext(ctx context.Context, src io.Reader, identities ...Identity) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var in io.Reader = &ctxReader{ctx: ctx, r: src}
+	if s, ok := src.(sizer); ok {
+		in = &ctxSizedReader{ctxReader{ctx: ctx, r: src}, s}
+	}
+	withCtx := func(o *decryptOptions) { o.ctx = ctx }
+	r, err := DecryptWithOptions(in, []DecryptOption{withCtx}, identities...)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := r.(progressReader); ok {
+		return &ctxProgressReader{ctxReader{ctx: ctx, r: r}, p}, nil
+	}
+	return &ctxReader{ctx: ctx, r: r}, nil
+}
+
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+type ctxWriteCloser struct {
+	ctxWriter
+	c io.Closer
+}
+
+func (w *ctxWriteCloser) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return w.c.Close()
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type sizer interface {
+	Size() int64
+}
+
+// ctxSizedReader preserves the Size method of src, which Decrypt uses to
+// report the total number of chunks through Progress.
+type ctxSizedReader struct {
+	ctxReader
+	s sizer
+}
+
+func (r *ctxSizedReader) Size() int64 {
+	return r.s.Size()
+}
+
+type progressReader interface {
+	Progress() (currentChunk, totalChunks int64)
+}
+
+// ctxProgressReader preserves the Progress method documented by Decrypt.
+type ctxProgressReader struct {
+	ctxReader
+	p progressReader
+}
+
+func (r *ctxProgressReader) Progress() (currentChunk, totalChunks int64) {
+	return r.p.Progress()
+}
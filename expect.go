@@ -0,0 +1,116 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age/internal/format"
+)
+
+// DecryptExpectingRecipients is like Decrypt, but it also checks that the file
+// was encrypted to exactly the expected recipients: every recipient stanza in
+// the header must correspond to one of them, and each of them must have a
+// stanza. This detects files encrypted to additional parties that could also
+// decrypt them. The check is performed after the header MAC is verified.
+//
+// The correspondence can only be checked as far as each recipient type allows.
+//
+//   - X25519Recipient stanzas are anonymous, so any X25519 stanza is accepted
+//     for any expected X25519Recipient. This means a file with one X25519
+//     stanza replaced with one for a different key is accepted.
+//   - Recipients whose String method returns an SSH public key, like those in
+//     the agessh package, are matched by the key fingerprint in the stanza.
+//   - ScryptRecipient is matched by stanza type.
+//
+// Other recipients, such as plugins, produce stanzas whose contents are opaque
+// to this package, and cause DecryptExpectingRecipients to return an error.
+// The stanza added by WithFilename is ignored.
+func DecryptExpectingRecipients(src io.Reader, expected []Recipient, identities ...Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	check, err := expectedStanzasCheck(expected)
+	if err != nil {
+		return nil, err
+	}
+	return decryptFile(src, &decryptOptions{checkStanzas: check}, identities)
+}
+
+// expectedStanzasCheck returns a function that checks that a list of stanzas
+// corresponds to the expected recipients, as documented in
+// DecryptExpectingRecipients.
+func expectedStanzasCheck(expected []Recipient) (func([]*Stanza) error, error) {
+	var matchers []func(*Stanza) bool
+	for i, r := range expected {
+		m, err := stanzaMatcher(r)
+		if err != nil {
+			return nil, fmt.Errorf("expected recipient #%d: %v", i, err)
+		}
+		matchers = append(matchers, m)
+	}
+	return func(stanzas []*Stanza) error {
+		var unmatched []*Stanza
+		for _, s := range stanzas {
+			if s.Type == filenameStanzaType {
+				continue
+			}
+			unmatched = append(unmatched, s)
+		}
+	Expected:
+		for i, m := range matchers {
+			for j, s := range unmatched {
+				if m(s) {
+					unmatched = append(unmatched[:j], unmatched[j+1:]...)
+					continue Expected
+				}
+			}
+			return fmt.Errorf("file is not encrypted to expected recipient #%d", i)
+		}
+		if len(unmatched) > 0 {
+			return fmt.Errorf("file is encrypted to %d unexpected recipient stanza(s), the first of type %q",
+				len(unmatched), unmatched[0].Type)
+		}
+		return nil
+	}, nil
+}
+
+func stanzaMatcher(r Recipient) (func(*Stanza) bool, error) {
+	switch r := r.(type) {
+	case *X25519Recipient:
+		return func(s *Stanza) bool { return s.Type == "X25519" }, nil
+	case *ScryptRecipient:
+		return func(s *Stanza) bool { return s.Type == "scrypt" }, nil
+	case fmt.Stringer:
+		keyType, tag, ok := sshKeyTag(r.String())
+		if !ok {
+			break
+		}
+		return func(s *Stanza) bool {
+			return s.Type == keyType && len(s.Args) > 0 && s.Args[0] == tag
+		}, nil
+	}
+	return nil, fmt.Errorf("stanzas of recipients of type %T can't be checked", r)
+}
+
+// sshKeyTag parses an SSH public key in authorized_keys format, and returns
+// its type and the fingerprint tag used in the stanzas of the agessh package.
+func sshKeyTag(s string) (keyType, tag string, ok bool) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || (fields[0] != "ssh-rsa" && fields[0] != "ssh-ed25519") {
+		return "", "", false
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", "", false
+	}
+	h := sha256.Sum256(key)
+	return fields[0], format.EncodeToString(h[:4]), true
+}
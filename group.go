@@ -0,0 +1,57 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// GroupRecipient returns a Recipient that wraps the file key to all of members,
+// so that a set of recipients, such as the keys of a team, can be handled as a
+// single value. Encrypting to it is equivalent to encrypting to each member.
+//
+// The group implements RecipientWithLabels. All members must have the same
+// labels, which are the labels of the group, or Wrap and WrapWithLabels fail.
+// This way, the group can only be combined with other recipients compatible
+// with each of the members, as if they were passed to Encrypt directly.
+func GroupRecipient(members ...Recipient) Recipient {
+	return &groupRecipient{members: append([]Recipient(nil), members...)}
+}
+
+type groupRecipient struct {
+	members []Recipient
+}
+
+var _ RecipientWithLabels = &groupRecipient{}
+
+func (g *groupRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	s, _, err := g.WrapWithLabels(fileKey)
+	return s, err
+}
+
+func (g *groupRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	if len(g.members) == 0 {
+		return nil, nil, errors.New("empty recipient group")
+	}
+	var stanzas []*Stanza
+	var labels []string
+	for i, r := range g.members {
+		s, l, err := wrapWithLabels(r, fileKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("group member #%d: %v", i, err)
+		}
+		l = append([]string(nil), l...)
+		sort.Strings(l)
+		if i == 0 {
+			labels = l
+		} else if !slicesEqual(labels, l) {
+			return nil, nil, fmt.Errorf("group member #%d is incompatible with the others", i)
+		}
+		stanzas = append(stanzas, s...)
+	}
+	return stanzas, labels, nil
+}
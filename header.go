@@ -0,0 +1,146 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/armor"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// BinaryMagic is the first line of every binary age file, including the
+// trailing newline. ASCII armored files instead start with armor.Header.
+const BinaryMagic = "age-encryption.org/v1\n"
+
+// IsEncryptedFile reports whether prefix is the start of an age file, either
+// binary or ASCII armored (see the armor package). A prefix shorter than the
+// relevant magic string is never detected as an age file.
+//
+// IsEncryptedFile only checks the magic strings, and does not validate the
+// rest of the file, which might still be malformed.
+func IsEncryptedFile(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(BinaryMagic)) ||
+		bytes.HasPrefix(prefix, []byte(armor.Header))
+}
+
+type headerJSON struct {
+	Armored    bool         `json:"armored"`
+	Recipients []stanzaJSON `json:"recipients"`
+	MAC        string       `json:"mac"`
+}
+
+type stanzaJSON struct {
+	Type    string   `json:"type"`
+	Args    []string `json:"args"`
+	BodyLen int      `json:"body_len"`
+}
+
+// HeaderJSON reads the header of the age file from src, and returns a stable
+// JSON representation of it, suitable for indexing. No decryption is
+// performed. src is read through a buffer, so some of the payload after the
+// header might be consumed from it, too.
+//
+// The JSON object has the following fields:
+//
+//   - "armored": a boolean, true if src is ASCII armored (see the armor package);
+//   - "recipients": an array of objects, one per recipient stanza in order, with
+//     a "type" string, an "args" array of strings, and a "body_len" number
+//     reporting the length of the stanza body in bytes;
+//   - "mac": the header MAC, encoded as unpadded standard base64 like in the
+//     header itself.
+//
+// Stanza bodies are never included, only their length. Note however that stanza
+// arguments might reveal information about the recipients, for example the
+// fingerprint of agessh recipients.
+func HeaderJSON(src io.Reader) ([]byte, error) {
+	h := &headerJSON{Recipients: []stanzaJSON{}}
+
+	rr := bufio.NewReader(src)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		h.Armored = true
+		src = armor.NewReader(rr)
+	} else {
+		src = rr
+	}
+
+	hdr, _, err := format.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	for _, s := range hdr.Recipients {
+		args := s.Args
+		if args == nil {
+			args = []string{}
+		}
+		h.Recipients = append(h.Recipients, stanzaJSON{
+			Type: s.Type, Args: args, BodyLen: len(s.Body),
+		})
+	}
+	h.MAC = format.EncodeToString(hdr.MAC)
+
+	return json.Marshal(h)
+}
+
+// Validate reads the whole age file from src, and checks that it's well-formed:
+// the header must parse, and the size of the payload must be consistent with
+// the chunked payload encryption. ASCII armored files are detected and decoded
+// (see the armor package).
+//
+// Validate doesn't need any identity, so it can't check the header MAC or
+// authenticate the payload. A file that passes Validate might still fail to
+// decrypt, but one that fails it will never decrypt successfully.
+func Validate(src io.Reader) error {
+	rr := bufio.NewReader(src)
+	if start, _ := rr.Peek(len(armor.Header)); string(start) == armor.Header {
+		src = armor.NewReader(rr)
+	} else {
+		src = rr
+	}
+
+	_, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	n, err := io.Copy(io.Discard, payload)
+	if err != nil {
+		return fmt.Errorf("failed to read payload: %w", err)
+	}
+	if n < streamNonceSize {
+		return errors.New("payload is too short to contain the nonce")
+	}
+	if _, err := stream.PlaintextSize(n - streamNonceSize); err != nil {
+		return fmt.Errorf("invalid payload size: %v", err)
+	}
+	return nil
+}
+
+// ComputeHeaderMAC returns the header MAC of a file with the given file key
+// and recipient stanzas, exactly as Encrypt computes it. The MAC is an
+// HMAC-SHA-256, keyed with a key derived from the file key, of the encoded
+// header up to and including the "---" that introduces the MAC (the same bytes
+// passed to IdentityWithHeader).
+//
+// This is only useful to tools that assemble headers manually, for example
+// combining stanzas produced elsewhere. The file key must be the one wrapped
+// by every stanza, and used for the payload, and the stanzas must be the ones
+// encoded in the header, in the same order, or the resulting file won't
+// decrypt.
+func ComputeHeaderMAC(fileKey []byte, stanzas []*Stanza) ([]byte, error) {
+	if len(fileKey) != fileKeySize {
+		return nil, errors.New("invalid file key size")
+	}
+	hdr := &format.Header{}
+	for _, s := range stanzas {
+		hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+	}
+	return headerMAC(fileKey, hdr)
+}
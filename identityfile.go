@@ -0,0 +1,154 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An IdentityFile is an identity file, in the format parsed by
+// ParseIdentities, loaded for editing. Comments, empty lines, and the order of
+// the lines are preserved.
+//
+// IdentityFile doesn't lock the file. Save replaces it atomically, so readers
+// never observe a partially written file, but concurrent editors can overwrite
+// each other's changes.
+type IdentityFile struct {
+	path  string
+	lines []identityLine
+}
+
+type identityLine struct {
+	text string
+	id   Identity // nil for comments and empty lines
+}
+
+// LoadIdentityFile reads the identity file at path. Like ParseIdentities, it
+// currently only supports native X25519 identities, but unlike it, a file with
+// no identities is not an error.
+func LoadIdentityFile(path string) (*IdentityFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	const privateKeySizeLimit = 1 << 24 // 16 MiB
+	if len(data) > privateKeySizeLimit {
+		return nil, fmt.Errorf("failed to read %q: file too large", path)
+	}
+	f := &IdentityFile{path: path}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "#") || line == "" {
+			f.lines = append(f.lines, identityLine{text: line})
+			continue
+		}
+		i, err := ParseX25519Identity(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: error at line %d: %v", path, n, err)
+		}
+		f.lines = append(f.lines, identityLine{text: line, id: i})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	return f, nil
+}
+
+// Identities returns the identities in the file, in order.
+func (f *IdentityFile) Identities() []Identity {
+	var ids []Identity
+	for _, l := range f.lines {
+		if l.id != nil {
+			ids = append(ids, l.id)
+		}
+	}
+	return ids
+}
+
+// Add appends id to the end of the file. id must implement fmt.Stringer,
+// returning its encoding on a single line, like X25519Identity does.
+func (f *IdentityFile) Add(id Identity) error {
+	s, ok := id.(fmt.Stringer)
+	if !ok {
+		return fmt.Errorf("identity of type %T can't be encoded", id)
+	}
+	line := s.String()
+	if line == "" || strings.HasPrefix(line, "#") || strings.ContainsAny(line, "\r\n") {
+		return fmt.Errorf("identity of type %T has an invalid encoding", id)
+	}
+	f.lines = append(f.lines, identityLine{text: line, id: id})
+	return nil
+}
+
+// Remove removes the identities for which remove returns true, and returns how
+// many were removed. Only the identity lines are removed: comments, such as
+// the ones age-keygen writes above each identity, are left in place.
+func (f *IdentityFile) Remove(remove func(Identity) bool) int {
+	var kept []identityLine
+	var n int
+	for _, l := range f.lines {
+		if l.id != nil && remove(l.id) {
+			n++
+			continue
+		}
+		kept = append(kept, l)
+	}
+	f.lines = kept
+	return n
+}
+
+// Save writes the file back to the path it was loaded from, preserving its
+// permissions. The contents are written to a temporary file in the same
+// directory, which is synced and then renamed over the original, so that the
+// file is replaced atomically.
+func (f *IdentityFile) Save() (err error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	for _, l := range f.lines {
+		if _, err := io.WriteString(w, l.text+"\n"); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
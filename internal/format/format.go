@@ -216,6 +216,10 @@ func (r *StanzaReader) ReadStanza() (s *Stanza, err error) {
 	}
 }
 
+// ErrNotAgeFile is wrapped by the errors returned by Parse if the input doesn't
+// start with the age intro line, or a prefix of it.
+var ErrNotAgeFile = errors.New("not an age file")
+
 type ParseError struct {
 	err error
 }
@@ -239,11 +243,14 @@ func Parse(input io.Reader) (*Header, io.Reader, error) {
 	rr := bufio.NewReader(input)
 
 	line, err := rr.ReadString('\n')
+	if err != nil && !strings.HasPrefix(intro, line) {
+		return nil, nil, errorf("%w: unexpected intro: %q", ErrNotAgeFile, line)
+	}
 	if err != nil {
 		return nil, nil, errorf("failed to read intro: %w", err)
 	}
 	if line != intro {
-		return nil, nil, errorf("unexpected intro: %q", line)
+		return nil, nil, errorf("%w: unexpected intro: %q", ErrNotAgeFile, line)
 	}
 
 	sr := NewStanzaReader(rr)
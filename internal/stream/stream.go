@@ -6,25 +6,40 @@
 package stream
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const ChunkSize = 64 * 1024
 
+// ErrReusedNonce is returned by Reader when a payload chunk fails to decrypt at
+// its position, but decrypts with the nonce of the first chunk. This indicates
+// a buggy encoder that reset its counter, or a replayed first chunk. Chunks
+// reused from any other position are reported as generic decryption failures.
+var ErrReusedNonce = errors.New("payload chunk was encrypted with a reused first-chunk nonce")
+
 type Reader struct {
 	a   cipher.AEAD
 	src io.Reader
 
-	unread []byte // decrypted but unread data, backed by buf
+	unread []byte // decrypted but unread data, backed by out
 	buf    [encChunkSize]byte
+	out    [ChunkSize]byte
 
 	err   error
 	nonce [chacha20poly1305.NonceSize]byte
+
+	chunks, totalChunks int64
+
+	// boundary, if not nil, is the prefix of a file that might follow the
+	// ciphertext, see SetBoundary. rest is the input read past the last chunk.
+	boundary, rest []byte
 }
 
 const (
@@ -38,11 +53,44 @@ func NewReader(key []byte, src io.Reader) (*Reader, error) {
 		return nil, err
 	}
 	return &Reader{
-		a:   aead,
-		src: src,
+		a:           aead,
+		src:         src,
+		totalChunks: -1,
 	}, nil
 }
 
+// SetCiphertextSize informs r of the total size of src, so that Progress can
+// report the total number of chunks.
+func (r *Reader) SetCiphertextSize(size int64) {
+	r.totalChunks = ChunkCount(size)
+}
+
+// SetBoundary makes r accept that the ciphertext is followed by more input
+// starting with prefix, such as the intro of another concatenated age file,
+// instead of EOF. The input after the last chunk is returned by Rest.
+//
+// Since the last chunk can be shorter than a full chunk, its end is found by
+// trying to decrypt it up to the first occurrences of prefix, up to
+// maxBoundaryAttempts of them. The ciphertext of an honest encoder contains
+// prefix only with negligible probability, so the first occurrence is the
+// boundary, and the limit stops a chunk full of copies of prefix from
+// causing thousands of decryption attempts.
+func (r *Reader) SetBoundary(prefix []byte) {
+	r.boundary = prefix
+}
+
+// Rest returns the unread input following the last chunk. It must only be
+// called after Read returned io.EOF, and only if SetBoundary was called.
+func (r *Reader) Rest() io.Reader {
+	return io.MultiReader(bytes.NewReader(r.rest), r.src)
+}
+
+// Progress returns the number of chunks decrypted so far, and the total number
+// of chunks, or -1 if SetCiphertextSize was not called.
+func (r *Reader) Progress() (currentChunk, totalChunks int64) {
+	return r.chunks, r.totalChunks
+}
+
 func (r *Reader) Read(p []byte) (int, error) {
 	if len(r.unread) > 0 {
 		n := copy(p, r.unread)
@@ -65,12 +113,16 @@ func (r *Reader) Read(p []byte) (int, error) {
 	n := copy(p, r.unread)
 	r.unread = r.unread[n:]
 
-	if last {
+	if last && r.boundary != nil {
+		// Any input after the last chunk is left for Rest.
+		r.err = io.EOF
+	} else if last {
 		// Ensure there is an EOF after the last chunk as expected. In other
 		// words, check for trailing data after a full-length final chunk.
 		// Hopefully, the underlying reader supports returning EOF even if it
-		// had previously returned an EOF to ReadFull.
-		if _, err := r.src.Read(make([]byte, 1)); err == nil {
+		// had previously returned an EOF to ReadFull. ReadFull retries reads
+		// that return (0, nil), which a single Read would mistake for data.
+		if _, err := io.ReadFull(r.src, make([]byte, 1)); err == nil {
 			r.err = errors.New("trailing data after end of encrypted file")
 		} else if err != io.EOF {
 			r.err = fmt.Errorf("non-EOF error reading after end of encrypted file: %w", err)
@@ -109,7 +161,10 @@ func (r *Reader) readChunk() (last bool, err error) {
 		return false, err
 	}
 
-	outBuf := make([]byte, 0, ChunkSize)
+	// Decrypting in place would be enough for a single attempt, but Open
+	// overwrites the destination on failure, and the chunk might have to be
+	// tried again as the last one.
+	outBuf := r.out[:0]
 	out, err := r.a.Open(outBuf, r.nonce[:], in, nil)
 	if err != nil && !last {
 		// Check if this was a full-length final chunk.
@@ -117,15 +172,303 @@ func (r *Reader) readChunk() (last bool, err error) {
 		setLastChunkFlag(&r.nonce)
 		out, err = r.a.Open(outBuf, r.nonce[:], in, nil)
 	}
+	if err != nil && r.boundary != nil {
+		// Check if the last chunk is followed by the boundary.
+		last = true
+		out, err = r.openBeforeBoundary(outBuf, in)
+	}
 	if err != nil {
+		if !nonceIsZero(&r.nonce) && r.opensWithFirstNonce(in) {
+			return false, ErrReusedNonce
+		}
 		return false, errors.New("failed to decrypt and authenticate payload chunk")
 	}
 
 	incNonce(&r.nonce)
-	r.unread = r.buf[:copy(r.buf[:], out)]
+	r.chunks++
+	r.unread = out
 	return last, nil
 }
 
+const maxBoundaryAttempts = 3
+
+// openBeforeBoundary tries to decrypt, as the last chunk, the prefixes of in
+// that are followed by r.boundary, or by a prefix of it at the end of in, up to
+// maxBoundaryAttempts of them. If one succeeds, the rest of in is saved in
+// r.rest. r.nonce must have the last chunk flag set.
+func (r *Reader) openBeforeBoundary(outBuf, in []byte) ([]byte, error) {
+	// Like in readChunk, only the first chunk can be empty.
+	start := r.a.Overhead()
+	if r.chunks > 0 {
+		start++
+	}
+	err := errors.New("no boundary found")
+	attempts := 0
+	for i := start; i < len(in) && attempts < maxBoundaryAttempts; i++ {
+		tail := in[i:]
+		if len(tail) > len(r.boundary) {
+			tail = tail[:len(r.boundary)]
+		}
+		if !bytes.Equal(tail, r.boundary[:len(tail)]) {
+			continue
+		}
+		attempts++
+		var out []byte
+		out, err = r.a.Open(outBuf, r.nonce[:], in[:i], nil)
+		if err == nil {
+			r.rest = append([]byte{}, in[i:]...)
+			return out, nil
+		}
+	}
+	return nil, err
+}
+
+// opensWithFirstNonce reports whether in decrypts with the nonce of the first
+// chunk, with or without the last chunk flag. It's only used to produce a more
+// specific error for a chunk that already failed to decrypt at its position.
+func (r *Reader) opensWithFirstNonce(in []byte) bool {
+	var nonce [chacha20poly1305.NonceSize]byte
+	if _, err := r.a.Open(nil, nonce[:], in, nil); err == nil {
+		return true
+	}
+	setLastChunkFlag(&nonce)
+	_, err := r.a.Open(nil, nonce[:], in, nil)
+	return err == nil
+}
+
+// DecryptReaderAt decrypts a STREAM ciphertext with random access.
+type DecryptReaderAt struct {
+	a      cipher.AEAD
+	src    io.ReaderAt
+	size   int64 // plaintext size
+	chunks int64
+
+	// mu protects the last decrypted chunk, which is kept to serve
+	// sequential small reads without decrypting the same chunk repeatedly.
+	mu         sync.Mutex
+	cacheIndex int64
+	cache      []byte
+}
+
+// NewDecryptReaderAt returns a DecryptReaderAt for the ciphertext of the given
+// size read from src. The last chunk is decrypted immediately, so that a
+// truncated ciphertext is detected and the plaintext size can be trusted.
+func NewDecryptReaderAt(key []byte, src io.ReaderAt, size int64) (*DecryptReaderAt, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintextSize, err := PlaintextSize(size)
+	if err != nil {
+		return nil, err
+	}
+	r := &DecryptReaderAt{
+		a:          aead,
+		src:        src,
+		size:       plaintextSize,
+		chunks:     ChunkCount(size),
+		cacheIndex: -1,
+	}
+	if _, err := r.chunk(r.chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *DecryptReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt. It's safe for concurrent use.
+func (r *DecryptReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	for len(p) > 0 && off < r.size {
+		chunk, err := r.chunk(off / ChunkSize)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p, chunk[off%ChunkSize:])
+		p = p[m:]
+		off += int64(m)
+		n += m
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk returns the plaintext of the chunk at index i, which must not be
+// modified.
+func (r *DecryptReaderAt) chunk(i int64) ([]byte, error) {
+	r.mu.Lock()
+	if r.cacheIndex == i {
+		defer r.mu.Unlock()
+		return r.cache, nil
+	}
+	r.mu.Unlock()
+
+	out, err := r.decryptChunk(i)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheIndex, r.cache = i, out
+	return out, nil
+}
+
+// decryptChunk reads and decrypts the chunk at index i, bypassing the cache.
+func (r *DecryptReaderAt) decryptChunk(i int64) ([]byte, error) {
+	off := i * encChunkSize
+	n := int64(encChunkSize)
+	if i == r.chunks-1 {
+		n = r.size - i*ChunkSize + chacha20poly1305.Overhead
+	}
+	// A ReaderAt can return fewer bytes than requested along with an error,
+	// even io.EOF at the end of a full read, and SectionReader with ReadFull
+	// takes care of looping over short reads.
+	in := make([]byte, n)
+	if _, err := io.ReadFull(io.NewSectionReader(r.src, off, n), in); err != nil {
+		return nil, fmt.Errorf("failed to read payload chunk: %w", err)
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	setNonceCounter(&nonce, uint64(i))
+	if i == r.chunks-1 {
+		setLastChunkFlag(&nonce)
+	}
+	out, err := r.a.Open(in[:0], nonce[:], in, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt and authenticate payload chunk")
+	}
+	return out, nil
+}
+
+// ParallelDecryptReader decrypts a STREAM ciphertext sequentially, like
+// Reader, but decrypts the chunks ahead of the reader across multiple
+// goroutines.
+type ParallelDecryptReader struct {
+	// results yields, in order, one channel per chunk that receives its
+	// plaintext once a worker decrypted it.
+	results chan chan chunkResult
+	done    chan struct{}
+	close   sync.Once
+
+	unread []byte
+	err    error
+}
+
+type chunkResult struct {
+	out []byte
+	err error
+}
+
+type chunkJob struct {
+	i   int64
+	res chan<- chunkResult
+}
+
+// NewParallelDecryptReader returns a ParallelDecryptReader for the ciphertext
+// of the given size read from src, which decrypts up to workers chunks at a
+// time, and buffers up to workers more decrypted chunks.
+//
+// Like NewDecryptReaderAt, it decrypts the last chunk immediately, so that a
+// truncated ciphertext is detected before any plaintext is returned. Close
+// must be called to stop the workers if the reader is not read to the end.
+func NewParallelDecryptReader(key []byte, src io.ReaderAt, size int64, workers int) (*ParallelDecryptReader, error) {
+	if workers < 1 {
+		return nil, errors.New("at least one worker is required")
+	}
+	ra, err := NewDecryptReaderAt(key, src, size)
+	if err != nil {
+		return nil, err
+	}
+	r := &ParallelDecryptReader{
+		results: make(chan chan chunkResult, workers),
+		done:    make(chan struct{}),
+	}
+	jobs := make(chan chunkJob)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for j := range jobs {
+				out, err := ra.decryptChunk(j.i)
+				j.res <- chunkResult{out: out, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(r.results)
+		defer close(jobs)
+		for i := int64(0); i < ra.chunks; i++ {
+			res := make(chan chunkResult, 1)
+			select {
+			case jobs <- chunkJob{i: i, res: res}:
+			case <-r.done:
+				return
+			}
+			select {
+			case r.results <- res:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+func (r *ParallelDecryptReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.unread) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		res, ok := <-r.results
+		if !ok {
+			select {
+			case <-r.done:
+				// Don't mistake the workers stopping for the end of the file.
+				r.err = errors.New("read from closed reader")
+			default:
+				r.err = io.EOF
+			}
+			continue
+		}
+		chunk := <-res
+		if chunk.err != nil {
+			r.err = chunk.err
+			r.Close()
+			continue
+		}
+		r.unread = chunk.out
+	}
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// Close stops the workers. It always returns nil.
+func (r *ParallelDecryptReader) Close() error {
+	r.close.Do(func() { close(r.done) })
+	return nil
+}
+
+// setNonceCounter sets the 88-bit big-endian chunk counter of nonce to i.
+func setNonceCounter(nonce *[chacha20poly1305.NonceSize]byte, i uint64) {
+	for j := len(nonce) - 2; j >= 0 && i > 0; j-- {
+		nonce[j] = byte(i)
+		i >>= 8
+	}
+}
+
 func incNonce(nonce *[chacha20poly1305.NonceSize]byte) {
 	for i := len(nonce) - 2; i >= 0; i-- {
 		nonce[i]++
@@ -146,6 +489,48 @@ func nonceIsZero(nonce *[chacha20poly1305.NonceSize]byte) bool {
 	return *nonce == [chacha20poly1305.NonceSize]byte{}
 }
 
+// EncryptedSize returns the size of the STREAM ciphertext of a plaintext of
+// the given size: every chunk, including an empty final one, grows by the
+// size of the authentication tag.
+func EncryptedSize(plaintextSize int64) (int64, error) {
+	if plaintextSize < 0 {
+		return 0, errors.New("negative plaintext size")
+	}
+	chunks := (plaintextSize + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return plaintextSize + chunks*chacha20poly1305.Overhead, nil
+}
+
+// ChunkCount returns the number of chunks in a STREAM ciphertext of the given
+// size. Every chunk but the last is full, and there is always at least one.
+func ChunkCount(ciphertextSize int64) int64 {
+	chunks := (ciphertextSize + encChunkSize - 1) / encChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return chunks
+}
+
+// PlaintextSize returns the size of the plaintext of a STREAM ciphertext of the
+// given size, or an error if no ciphertext can have that size. It's the inverse
+// of EncryptedSize.
+func PlaintextSize(ciphertextSize int64) (int64, error) {
+	if ciphertextSize < chacha20poly1305.Overhead {
+		return 0, errors.New("payload is shorter than a chunk tag")
+	}
+	chunks := ChunkCount(ciphertextSize)
+	last := ciphertextSize - (chunks-1)*encChunkSize
+	if last < chacha20poly1305.Overhead {
+		return 0, errors.New("last chunk is shorter than a chunk tag")
+	}
+	if last == chacha20poly1305.Overhead && chunks > 1 {
+		return 0, errors.New("last chunk is empty")
+	}
+	return ciphertextSize - chunks*chacha20poly1305.Overhead, nil
+}
+
 type Writer struct {
 	a         cipher.AEAD
 	dst       io.Writer
@@ -8,7 +8,9 @@ import (
 	"bytes"
 	"crypto/rand"
 	"fmt"
+	"io"
 	"testing"
+	"testing/iotest"
 
 	"filippo.io/age/internal/stream"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -75,6 +77,7 @@ func testRoundTrip(t *testing.T, stepSize, length int) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	r.SetCiphertextSize(int64(buf.Len()))
 
 	n = 0
 	readBuf := make([]byte, stepSize)
@@ -90,4 +93,387 @@ func testRoundTrip(t *testing.T, stepSize, length int) {
 
 		n += nn
 	}
+
+	expectedChunks := int64((length + cs - 1) / cs)
+	if expectedChunks == 0 {
+		expectedChunks = 1
+	}
+	current, total := r.Progress()
+	if total != expectedChunks {
+		t.Errorf("Progress returned %d total chunks, expected %d", total, expectedChunks)
+	}
+	if length > 0 && current != total {
+		t.Errorf("Progress returned %d current chunks at the end, expected %d", current, total)
+	}
+}
+
+func encryptForTest(t testing.TB, key, src []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := stream.NewWriter(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zeroReadsReader returns (0, nil) before every successful Read.
+type zeroReadsReader struct {
+	r    io.Reader
+	zero bool
+}
+
+func (z *zeroReadsReader) Read(p []byte) (int, error) {
+	if z.zero = !z.zero; z.zero {
+		return 0, nil
+	}
+	return z.r.Read(p)
+}
+
+func TestTrailingData(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	readers := map[string]func(io.Reader) io.Reader{
+		"OneByteReader": iotest.OneByteReader,
+		"zeroReads":     func(r io.Reader) io.Reader { return &zeroReadsReader{r: r} },
+	}
+	for _, length := range []int{0, 1000, cs, cs + 100} {
+		ciphertext := encryptForTest(t, key, make([]byte, length))
+
+		for name, wrap := range readers {
+			t.Run(fmt.Sprintf("len=%d,%s", length, name), func(t *testing.T) {
+				r, err := stream.NewReader(key, wrap(bytes.NewReader(ciphertext)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out, err := io.ReadAll(r); err != nil {
+					t.Errorf("clean input: unexpected error: %v", err)
+				} else if len(out) != length {
+					t.Errorf("clean input: got %d bytes, expected %d", len(out), length)
+				}
+
+				trailing := append(ciphertext[:len(ciphertext):len(ciphertext)], 0)
+				r, err = stream.NewReader(key, wrap(bytes.NewReader(trailing)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadAll(r); err == nil {
+					t.Error("trailing data: expected an error")
+				}
+			})
+		}
+	}
+}
+
+func TestReusedNonce(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	encChunk := cs + chacha20poly1305.Overhead
+	long := encryptForTest(t, key, make([]byte, cs+100))
+	short := encryptForTest(t, key, make([]byte, 100))
+
+	for _, tt := range []struct {
+		name       string
+		ciphertext []byte
+	}{
+		// An encoder that reset the counter before the last chunk.
+		{"reset", append(append([]byte{}, long[:encChunk]...), short...)},
+		// The first chunk, replayed as the second one.
+		{"replay", append(append([]byte{}, long[:encChunk]...), long...)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := stream.NewReader(key, bytes.NewReader(tt.ciphertext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err != stream.ErrReusedNonce {
+				t.Errorf("got %v, expected ErrReusedNonce", err)
+			}
+		})
+	}
+
+	// Only the first chunk nonce is checked: a chunk that is just corrupted,
+	// or a non-first chunk replayed later, is a generic decryption error.
+	corrupted := append([]byte{}, long...)
+	corrupted[len(corrupted)-1] ^= 1
+	longer := encryptForTest(t, key, make([]byte, 2*cs+100))
+	replayed := append([]byte{}, longer[:2*encChunk]...)
+	replayed = append(replayed, longer[encChunk:2*encChunk]...)
+	replayed = append(replayed, longer[2*encChunk:]...)
+	for _, tt := range []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"corrupted", corrupted},
+		{"replay second", replayed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := stream.NewReader(key, bytes.NewReader(tt.ciphertext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil || err == stream.ErrReusedNonce {
+				t.Errorf("got %v, expected a decryption error", err)
+			}
+		})
+	}
+}
+
+func TestSetBoundary(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	boundary := []byte("age-encryption.org/v1\n")
+	decrypt := func(ciphertext []byte) ([]byte, []byte, error) {
+		r, err := stream.NewReader(key, bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetBoundary(boundary)
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		rest, err := io.ReadAll(r.Rest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, rest, nil
+	}
+
+	for _, length := range []int{0, 1000, cs - 10, cs + 100} {
+		src := make([]byte, length)
+		if _, err := rand.Read(src); err != nil {
+			t.Fatal(err)
+		}
+		next := append(append([]byte{}, boundary...), "next file"...)
+		ciphertext := append(encryptForTest(t, key, src), next...)
+		out, rest, err := decrypt(ciphertext)
+		if err != nil {
+			t.Errorf("len=%d: %v", length, err)
+		} else if !bytes.Equal(out, src) || !bytes.Equal(rest, next) {
+			t.Errorf("len=%d: wrong plaintext or rest", length)
+		}
+	}
+
+	// A chunk full of copies of the boundary is rejected after a few
+	// attempts, instead of trying to decrypt up to each of them.
+	garbage := bytes.Repeat(boundary, cs/len(boundary))
+	if _, _, err := decrypt(garbage); err == nil {
+		t.Error("garbage: expected an error")
+	}
+
+	// That holds even if the chunk is valid, which only someone who knows the
+	// key can produce, by picking the plaintext that encrypts to the copies.
+	copies := bytes.Repeat(boundary, 100)
+	keystream := encryptForTest(t, key, make([]byte, len(copies)))
+	src := make([]byte, len(copies))
+	for i := range src {
+		src[i] = copies[i] ^ keystream[i]
+	}
+	ciphertext := encryptForTest(t, key, src)
+	if !bytes.HasPrefix(ciphertext, copies) {
+		t.Fatal("failed to craft the ciphertext")
+	}
+	if _, _, err := decrypt(append(ciphertext, boundary...)); err == nil {
+		t.Error("crafted: expected an error")
+	}
+}
+
+func TestPlaintextSize(t *testing.T) {
+	for _, size := range []int64{0, 1, cs - 1, cs, cs + 1, 2 * cs, 2*cs + 1, 10*cs + 500} {
+		encSize, err := stream.EncryptedSize(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := stream.PlaintextSize(encSize)
+		if err != nil {
+			t.Errorf("PlaintextSize(%d): %v", encSize, err)
+		} else if got != size {
+			t.Errorf("PlaintextSize(%d) = %d, expected %d", encSize, got, size)
+		}
+	}
+
+	const encChunk = cs + chacha20poly1305.Overhead
+	for _, size := range []int64{0, chacha20poly1305.Overhead - 1,
+		encChunk + chacha20poly1305.Overhead - 1, encChunk + chacha20poly1305.Overhead} {
+		if _, err := stream.PlaintextSize(size); err == nil {
+			t.Errorf("PlaintextSize(%d) succeeded, expected an error", size)
+		}
+	}
+}
+
+// oneByteReaderAt returns at most one byte per ReadAt call, to check that
+// short reads are handled.
+type oneByteReaderAt struct{ r io.ReaderAt }
+
+func (r oneByteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	n, err := r.r.ReadAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestDecryptReaderAt(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{0, 1000, cs, cs + 100, 3 * cs} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			ciphertext := encryptForTest(t, key, src)
+
+			r, err := stream.NewDecryptReaderAt(key, bytes.NewReader(ciphertext), int64(len(ciphertext)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(length) {
+				t.Errorf("Size() = %d, expected %d", r.Size(), length)
+			}
+			for _, off := range []int{0, 1, cs - 1, cs, cs + 50, length - 1, length} {
+				if off < 0 || off > length {
+					continue
+				}
+				p := make([]byte, 1000)
+				n, err := r.ReadAt(p, int64(off))
+				exp := src[off:]
+				if len(exp) > len(p) {
+					exp = exp[:len(p)]
+				}
+				if !bytes.Equal(p[:n], exp) {
+					t.Errorf("ReadAt(%d): wrong data", off)
+				}
+				if n < len(p) && err != io.EOF {
+					t.Errorf("ReadAt(%d) returned %d bytes and %v, expected io.EOF", off, n, err)
+				} else if n == len(p) && err != nil {
+					t.Errorf("ReadAt(%d): %v", off, err)
+				}
+			}
+
+			r, err = stream.NewDecryptReaderAt(key, oneByteReaderAt{bytes.NewReader(ciphertext)}, int64(len(ciphertext)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, src) {
+				t.Error("wrong data with short reads")
+			}
+
+			if length > cs {
+				// Truncated at a chunk boundary, the ciphertext still has a
+				// valid size, but the new last chunk is not marked as such.
+				truncated := ciphertext[:cs+chacha20poly1305.Overhead]
+				if _, err := stream.NewDecryptReaderAt(key, bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+					t.Error("expected an error for a truncated ciphertext")
+				}
+			}
+		})
+	}
+}
+
+func TestParallelDecryptReader(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{0, 1000, cs, 5*cs + 100} {
+		for _, workers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("len=%d,workers=%d", length, workers), func(t *testing.T) {
+				src := make([]byte, length)
+				if _, err := rand.Read(src); err != nil {
+					t.Fatal(err)
+				}
+				ciphertext := encryptForTest(t, key, src)
+				size := int64(len(ciphertext))
+
+				r, err := stream.NewParallelDecryptReader(key, bytes.NewReader(ciphertext), size, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err := io.ReadAll(iotest.OneByteReader(r))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, src) {
+					t.Error("wrong data")
+				}
+				r.Close()
+
+				if length <= cs {
+					return
+				}
+
+				// Truncated at a chunk boundary, the ciphertext still has a
+				// valid size, but the new last chunk is not marked as such.
+				truncated := ciphertext[:cs+chacha20poly1305.Overhead]
+				if _, err := stream.NewParallelDecryptReader(key, bytes.NewReader(truncated), int64(len(truncated)), workers); err == nil {
+					t.Error("expected an error for a truncated ciphertext")
+				}
+
+				corrupted := append([]byte{}, ciphertext...)
+				corrupted[2*cs+100] ^= 1
+				r, err = stream.NewParallelDecryptReader(key, bytes.NewReader(corrupted), size, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, err = io.ReadAll(r)
+				if err == nil {
+					t.Error("expected an error for a corrupted chunk")
+				}
+				if !bytes.Equal(out, src[:2*cs]) {
+					t.Errorf("got %d bytes before the corrupted chunk, expected %d", len(out), 2*cs)
+				}
+
+				r, err = stream.NewParallelDecryptReader(key, bytes.NewReader(ciphertext), size, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := r.Read(make([]byte, 10)); err != nil {
+					t.Fatal(err)
+				}
+				r.Close()
+				if _, err := io.ReadAll(r); err == nil {
+					t.Error("expected an error reading past Close")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkParallelDecryptReader(b *testing.B) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	ciphertext := encryptForTest(b, key, make([]byte, 64*cs))
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(ciphertext)))
+			for i := 0; i < b.N; i++ {
+				r, err := stream.NewParallelDecryptReader(key,
+					bytes.NewReader(ciphertext), int64(len(ciphertext)), workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
@@ -6,9 +6,11 @@ package age
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 )
 
 // ParseIdentities parses a file with one or more private key encodings, one per
@@ -82,3 +84,124 @@ func ParseRecipients(f io.Reader) ([]Recipient, error) {
 	}
 	return recs, nil
 }
+
+// ParseConfig parses a file with a "[recipients]" and an "[identities]"
+// section, each followed by encodings in the format of ParseRecipients and
+// ParseIdentities, respectively. Either section may be missing, empty, or
+// repeated, but there must be at least one recipient or identity, and every
+// encoding must be in a section. Empty lines and lines starting with "#" are
+// ignored, and leading and trailing whitespace is trimmed.
+//
+// For example
+//
+//	# created: 2023-01-01T00:00:00Z
+//	[recipients]
+//	age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+//
+//	[identities]
+//	AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX
+//
+// Like those functions, currently all returned values are of type
+// *X25519Recipient and *X25519Identity, but different types might be returned
+// in the future.
+func ParseConfig(f io.Reader) (recipients []Recipient, identities []Identity, err error) {
+	const configFileSizeLimit = 1 << 24 // 16 MiB
+	scanner := bufio.NewScanner(io.LimitReader(f, configFileSizeLimit))
+	// Each section is split out into its own file and passed to
+	// ParseRecipients or ParseIdentities. Lines from other sections are left
+	// empty, so that the line numbers in their errors still match.
+	var recs, ids strings.Builder
+	var hasRecs, hasIDs bool
+	var section string
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#") || line == "":
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section != "recipients" && section != "identities" {
+				return nil, nil, fmt.Errorf("unknown section %q at line %d", section, n)
+			}
+		case section == "recipients":
+			recs.WriteString(line)
+			hasRecs = true
+		case section == "identities":
+			ids.WriteString(line)
+			hasIDs = true
+		default:
+			return nil, nil, fmt.Errorf("line %d is not in a [recipients] or [identities] section", n)
+		}
+		recs.WriteString("\n")
+		ids.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if !hasRecs && !hasIDs {
+		return nil, nil, fmt.Errorf("no recipients or identities found")
+	}
+	if hasRecs {
+		recipients, err = ParseRecipients(strings.NewReader(recs.String()))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if hasIDs {
+		identities, err = ParseIdentities(strings.NewReader(ids.String()))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return recipients, identities, nil
+}
+
+// A RecipientEntry is a recipient to be written by WriteRecipientsFile.
+type RecipientEntry struct {
+	// Recipient must implement fmt.Stringer, returning the recipient encoding,
+	// like X25519Recipient and the recipients in the agessh package do.
+	Recipient Recipient
+
+	// Comment is an optional label, written as one or more comment lines
+	// before the recipient. It may contain newlines.
+	Comment string
+}
+
+// WriteRecipientsFile writes a recipients file with one recipient per line,
+// each preceded by its comment, if any. The file starts with a "# created:"
+// comment reporting the current time, like the identity files generated by
+// age-keygen.
+//
+// The output can be read back by ParseRecipients or by the CLI, which ignore
+// the comments.
+func WriteRecipientsFile(w io.Writer, entries []RecipientEntry) error {
+	if len(entries) == 0 {
+		return errors.New("no recipients specified")
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# created: %s\n", time.Now().Format(time.RFC3339))
+	for n, e := range entries {
+		s, ok := e.Recipient.(fmt.Stringer)
+		if !ok {
+			return fmt.Errorf("recipient %d of type %T can't be encoded", n, e.Recipient)
+		}
+		r := s.String()
+		if r == "" || strings.HasPrefix(r, "#") || strings.ContainsAny(r, "\r\n") {
+			return fmt.Errorf("recipient %d of type %T has an invalid encoding", n, e.Recipient)
+		}
+		if e.Comment != "" {
+			for _, line := range strings.Split(e.Comment, "\n") {
+				line = strings.TrimSuffix(line, "\r")
+				if line == "" {
+					b.WriteString("#\n")
+				} else {
+					fmt.Fprintf(b, "# %s\n", line)
+				}
+			}
+		}
+		fmt.Fprintf(b, "%s\n", r)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
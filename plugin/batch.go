@@ -0,0 +1,90 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import "filippo.io/age"
+
+// BatchRecipients returns recipients with all the *Recipient values for the
+// same plugin combined into one, so that the plugin is executed only once and
+// receives all its recipients together. This lets plugins make decisions based
+// on the whole set of recipients, as the protocol intends. Without batching,
+// each Recipient executes the plugin separately.
+//
+// The combined Recipient takes the place of the first one for its plugin, and
+// uses its ClientUI and options. Recipients of other types are returned as-is.
+// Errors the plugin reports about a specific recipient mention its index in
+// recipients.
+func BatchRecipients(recipients []age.Recipient) []age.Recipient {
+	var batched []age.Recipient
+	batches := make(map[string]*recipientBatch)
+	for i, r := range recipients {
+		pr, ok := r.(*Recipient)
+		if !ok {
+			batched = append(batched, r)
+			continue
+		}
+		b, ok := batches[pr.name]
+		if !ok {
+			b = &recipientBatch{}
+			batches[pr.name] = b
+			batched = append(batched, b)
+		}
+		b.members = append(b.members, pr)
+		b.indexes = append(b.indexes, i)
+	}
+	return batched
+}
+
+type recipientBatch struct {
+	members []*Recipient
+	indexes []int
+}
+
+var _ age.RecipientWithLabels = &recipientBatch{}
+
+func (b *recipientBatch) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	s, _, err := b.WrapWithLabels(fileKey)
+	return s, err
+}
+
+func (b *recipientBatch) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	return wrapWithPlugin(b.members, b.indexes, fileKey)
+}
+
+// BatchIdentities is like BatchRecipients, but for *Identity values. The
+// combined Identity is tried when the first one for its plugin would have been,
+// and the plugin receives all its identities at once. Errors the plugin
+// reports about a specific identity mention its index in identities.
+func BatchIdentities(identities []age.Identity) []age.Identity {
+	var batched []age.Identity
+	batches := make(map[string]*identityBatch)
+	for i, id := range identities {
+		pi, ok := id.(*Identity)
+		if !ok {
+			batched = append(batched, id)
+			continue
+		}
+		b, ok := batches[pi.name]
+		if !ok {
+			b = &identityBatch{}
+			batches[pi.name] = b
+			batched = append(batched, b)
+		}
+		b.members = append(b.members, pi)
+		b.indexes = append(b.indexes, i)
+	}
+	return batched
+}
+
+type identityBatch struct {
+	members []*Identity
+	indexes []int
+}
+
+var _ age.Identity = &identityBatch{}
+
+func (b *identityBatch) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	return unwrapWithPlugin(b.members, b.indexes, stanzas)
+}
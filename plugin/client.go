@@ -9,8 +9,11 @@ package plugin
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -28,6 +31,7 @@ type Recipient struct {
 	name     string
 	encoding string
 	ui       *ClientUI
+	opts     options
 
 	// identity is true when encoding is an identity string.
 	identity bool
@@ -36,13 +40,13 @@ type Recipient struct {
 var _ age.Recipient = &Recipient{}
 var _ age.RecipientWithLabels = &Recipient{}
 
-func NewRecipient(s string, ui *ClientUI) (*Recipient, error) {
+func NewRecipient(s string, ui *ClientUI, opts ...Option) (*Recipient, error) {
 	name, _, err := ParseRecipient(s)
 	if err != nil {
 		return nil, err
 	}
 	return &Recipient{
-		name: name, encoding: s, ui: ui,
+		name: name, encoding: s, ui: ui, opts: newOptions(opts),
 	}, nil
 }
 
@@ -53,31 +57,63 @@ func (r *Recipient) Name() string {
 	return r.name
 }
 
+// String returns the recipient encoding ("age1name1..."), or an empty string
+// if r was returned by Identity.Recipient, so that the secret identity encoding
+// is not exposed.
+func (r *Recipient) String() string {
+	if r.identity {
+		return ""
+	}
+	return r.encoding
+}
+
 func (r *Recipient) Wrap(fileKey []byte) (stanzas []*age.Stanza, err error) {
 	stanzas, _, err = r.WrapWithLabels(fileKey)
 	return
 }
 
 func (r *Recipient) WrapWithLabels(fileKey []byte) (stanzas []*age.Stanza, labels []string, err error) {
+	return wrapWithPlugin([]*Recipient{r}, nil, fileKey)
+}
+
+// wrapWithPlugin runs the recipient-v1 protocol with all of members in the same
+// plugin process. The members must share a plugin name, and the ClientUI and
+// options of the first one are used. If indexes is not nil, errors about a
+// specific member mention indexes[i] for members[i].
+func wrapWithPlugin(members []*Recipient, indexes []int, fileKey []byte) (stanzas []*age.Stanza, labels []string, err error) {
+	name, ui, ctx := members[0].name, members[0].ui, members[0].opts.ctx
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("%s plugin: %w", r.name, err)
+			if ctx.Err() != nil {
+				// The plugin was stopped, so err is just a broken pipe.
+				err = ctx.Err()
+			}
+			err = fmt.Errorf("%s plugin: %w", name, err)
 		}
 	}()
 
-	conn, err := openClientConnection(r.name, "recipient-v1")
+	conn, err := openClientConnection(name, "recipient-v1", members[0].opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't start plugin: %v", err)
+		return nil, nil, fmt.Errorf("couldn't start plugin: %w", err)
 	}
 	defer conn.Close()
 
-	// Phase 1: client sends recipient or identity and file key
-	addType := "add-recipient"
-	if r.identity {
-		addType = "add-identity"
-	}
-	if err := writeStanza(conn, addType, r.encoding); err != nil {
-		return nil, nil, err
+	// Phase 1: client sends recipients or identities and file key
+	//
+	// The plugin reports errors by the position of the recipient among the
+	// add-recipient stanzas, or of the identity among the add-identity ones.
+	var recipientMembers, identityMembers []int
+	for i, r := range members {
+		addType := "add-recipient"
+		if r.identity {
+			addType = "add-identity"
+			identityMembers = append(identityMembers, i)
+		} else {
+			recipientMembers = append(recipientMembers, i)
+		}
+		if err := writeStanza(conn, addType, r.encoding); err != nil {
+			return nil, nil, err
+		}
 	}
 	if err := writeStanza(conn, fmt.Sprintf("grease-%x", rand.Int())); err != nil {
 		return nil, nil, err
@@ -96,7 +132,7 @@ func (r *Recipient) WrapWithLabels(fileKey []byte) (stanzas []*age.Stanza, label
 	sr := format.NewStanzaReader(bufio.NewReader(conn))
 ReadLoop:
 	for {
-		s, err := r.ui.readStanza(r.name, sr)
+		s, err := ui.readStanza(name, sr)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -138,11 +174,23 @@ ReadLoop:
 				return nil, nil, err
 			}
 
+			if indexes != nil && len(s.Args) == 2 {
+				var positions []int
+				switch s.Args[0] {
+				case "recipient":
+					positions = recipientMembers
+				case "identity":
+					positions = identityMembers
+				}
+				if n, err := strconv.Atoi(s.Args[1]); err == nil && n >= 0 && n < len(positions) {
+					return nil, nil, fmt.Errorf("recipient #%d: %s", indexes[positions[n]], s.Body)
+				}
+			}
 			return nil, nil, fmt.Errorf("%s", s.Body)
 		case "done":
 			break ReadLoop
 		default:
-			if ok, err := r.ui.handle(r.name, conn, s); err != nil {
+			if ok, err := ui.handle(name, conn, s); err != nil {
 				return nil, nil, err
 			} else if !ok {
 				if err := writeStanza(conn, "unsupported"); err != nil {
@@ -163,27 +211,28 @@ type Identity struct {
 	name     string
 	encoding string
 	ui       *ClientUI
+	opts     options
 }
 
 var _ age.Identity = &Identity{}
 
-func NewIdentity(s string, ui *ClientUI) (*Identity, error) {
+func NewIdentity(s string, ui *ClientUI, opts ...Option) (*Identity, error) {
 	name, _, err := ParseIdentity(s)
 	if err != nil {
 		return nil, err
 	}
 	return &Identity{
-		name: name, encoding: s, ui: ui,
+		name: name, encoding: s, ui: ui, opts: newOptions(opts),
 	}, nil
 }
 
-func NewIdentityWithoutData(name string, ui *ClientUI) (*Identity, error) {
+func NewIdentityWithoutData(name string, ui *ClientUI, opts ...Option) (*Identity, error) {
 	s := EncodeIdentity(name, nil)
 	if s == "" {
 		return nil, fmt.Errorf("invalid plugin name: %q", name)
 	}
 	return &Identity{
-		name: name, encoding: s, ui: ui,
+		name: name, encoding: s, ui: ui, opts: newOptions(opts),
 	}, nil
 }
 
@@ -194,6 +243,12 @@ func (i *Identity) Name() string {
 	return i.name
 }
 
+// String returns the identity encoding ("AGE-PLUGIN-NAME-1..."). Like the
+// encoding of other identities, it might contain secret key material.
+func (i *Identity) String() string {
+	return i.encoding
+}
+
 // Recipient returns a Recipient wrapping this identity. When that Recipient is
 // used to encrypt a file key, the identity encoding is provided as-is to the
 // plugin, which is expected to support encrypting to identities.
@@ -203,25 +258,39 @@ func (i *Identity) Recipient() *Recipient {
 		encoding: i.encoding,
 		identity: true,
 		ui:       i.ui,
+		opts:     i.opts,
 	}
 }
 
 func (i *Identity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
+	return unwrapWithPlugin([]*Identity{i}, nil, stanzas)
+}
+
+// unwrapWithPlugin runs the identity-v1 protocol with all of members in the
+// same plugin process, like wrapWithPlugin.
+func unwrapWithPlugin(members []*Identity, indexes []int, stanzas []*age.Stanza) (fileKey []byte, err error) {
+	name, ui, ctx := members[0].name, members[0].ui, members[0].opts.ctx
 	defer func() {
 		if err != nil {
-			err = fmt.Errorf("%s plugin: %w", i.name, err)
+			if ctx.Err() != nil {
+				// The plugin was stopped, so err is just a broken pipe.
+				err = ctx.Err()
+			}
+			err = fmt.Errorf("%s plugin: %w", name, err)
 		}
 	}()
 
-	conn, err := openClientConnection(i.name, "identity-v1")
+	conn, err := openClientConnection(name, "identity-v1", members[0].opts)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't start plugin: %v", err)
+		return nil, fmt.Errorf("couldn't start plugin: %w", err)
 	}
 	defer conn.Close()
 
-	// Phase 1: client sends the plugin the identity string and the stanzas
-	if err := writeStanza(conn, "add-identity", i.encoding); err != nil {
-		return nil, err
+	// Phase 1: client sends the plugin the identity strings and the stanzas
+	for _, i := range members {
+		if err := writeStanza(conn, "add-identity", i.encoding); err != nil {
+			return nil, err
+		}
 	}
 	if err := writeStanza(conn, fmt.Sprintf("grease-%x", rand.Int())); err != nil {
 		return nil, err
@@ -244,7 +313,7 @@ func (i *Identity) Unwrap(stanzas []*age.Stanza) (fileKey []byte, err error) {
 	sr := format.NewStanzaReader(bufio.NewReader(conn))
 ReadLoop:
 	for {
-		s, err := i.ui.readStanza(i.name, sr)
+		s, err := ui.readStanza(name, sr)
 		if err != nil {
 			return nil, err
 		}
@@ -276,11 +345,16 @@ ReadLoop:
 				return nil, err
 			}
 
+			if indexes != nil && len(s.Args) == 2 && s.Args[0] == "identity" {
+				if n, err := strconv.Atoi(s.Args[1]); err == nil && n >= 0 && n < len(indexes) {
+					return nil, fmt.Errorf("identity #%d: %s", indexes[n], s.Body)
+				}
+			}
 			return nil, fmt.Errorf("%s", s.Body)
 		case "done":
 			break ReadLoop
 		default:
-			if ok, err := i.ui.handle(i.name, conn, s); err != nil {
+			if ok, err := ui.handle(name, conn, s); err != nil {
 				return nil, err
 			} else if !ok {
 				if err := writeStanza(conn, "unsupported"); err != nil {
@@ -296,6 +370,91 @@ ReadLoop:
 	return fileKey, nil
 }
 
+// An Option configures the behavior of a Recipient or Identity.
+type Option func(*options)
+
+type options struct {
+	verifyBinary func(path string) error
+
+	startRetries int
+	startBackoff time.Duration
+
+	inProcess *Plugin
+
+	ctx context.Context
+}
+
+func newOptions(opts []Option) options {
+	o := options{ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithBinaryVerifier sets a function that is invoked with the resolved path of
+// the plugin binary every time before executing it. If verify returns an error,
+// the plugin is not executed and the operation fails.
+//
+// verify can be used for example to check the binary against a pinned hash.
+// Note that the binary is executed by path after verify returns, so the
+// directory containing it must not be writable by untrusted users.
+func WithBinaryVerifier(verify func(path string) error) Option {
+	return func(o *options) { o.verifyBinary = verify }
+}
+
+// WithStartRetries makes the client retry starting the plugin binary up to
+// retries more times if it fails for a reason other than the binary not being
+// found, for example because it's still being written. The first retry waits
+// for backoff, and each subsequent one waits twice as long as the previous.
+//
+// A missing binary is never retried, and is reported as a *NotFoundError.
+func WithStartRetries(retries int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.startRetries = retries
+		o.startBackoff = backoff
+	}
+}
+
+// WithInProcess makes the client run the protocol against p in a separate
+// goroutine, instead of executing the plugin binary. It is meant for testing
+// plugins built with the Plugin framework, without installing them in $PATH.
+//
+// p must have the same name as the recipient or identity, and its Handle
+// methods must have been called already. Operations using the same p are
+// serialized. Errors that the plugin reports outside the protocol are printed
+// to standard error, like they would be by a plugin binary.
+func WithInProcess(p *Plugin) Option {
+	return func(o *options) { o.inProcess = p }
+}
+
+// WithContext makes the client stop the plugin once ctx is done, by killing the
+// plugin binary or, with WithInProcess, by closing its connection. Wrap and
+// Unwrap then fail with an error wrapping ctx.Err(). This can be used to
+// interrupt a plugin that is waiting for user interaction, for example along
+// with age.DecryptContext. ClientUI callbacks are not interrupted.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) { o.ctx = ctx }
+}
+
+// NotFoundError is returned, wrapped, by Recipient.Wrap and Identity.Unwrap
+// when the plugin binary can't be found.
+type NotFoundError struct {
+	// Name is the plugin (not binary) name.
+	Name string
+	// Err is the underlying error, usually an *exec.Error wrapping
+	// exec.ErrNotFound.
+	Err error
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%q plugin not found: %v", e.Name, e.Err)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
 // ClientUI holds callbacks that will be invoked by (Un)Wrap if the plugin
 // wishes to interact with the user. If any of them is nil or returns an error,
 // failure will be reported to the plugin, but note that the error is otherwise
@@ -382,22 +541,73 @@ func (c *ClientUI) readStanza(name string, r *format.StanzaReader) (*format.Stan
 }
 
 type clientConnection struct {
-	cmd       *exec.Cmd
 	io.Reader // stdout
 	io.Writer // stdin
 	close     func()
+	wait      func() error
 }
 
 var testOnlyPluginPath string
 
-func openClientConnection(name, protocol string) (*clientConnection, error) {
+func openClientConnection(name, protocol string, opts options) (*clientConnection, error) {
+	if opts.inProcess != nil {
+		return runInProcess(opts.ctx, opts.inProcess, name, protocol)
+	}
 	path := "age-plugin-" + name
 	if testOnlyPluginPath != "" {
 		path = filepath.Join(testOnlyPluginPath, path)
 	} else if strings.ContainsRune(name, os.PathSeparator) {
 		return nil, fmt.Errorf("invalid plugin name: %q", name)
 	}
-	cmd := exec.Command(path, "--age-plugin="+protocol)
+	if !pluginAllowed(name) {
+		return nil, fmt.Errorf("plugin %q not permitted by $AGE_PLUGIN_ALLOWLIST", name)
+	}
+	backoff := opts.startBackoff
+	for attempt := 0; ; attempt++ {
+		cc, err := startPlugin(path, protocol, opts)
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return nil, &NotFoundError{Name: name, Err: err}
+		}
+		if err == nil || attempt >= opts.startRetries {
+			return cc, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// pluginAllowed reports whether the plugin binary for name may be executed.
+// If $AGE_PLUGIN_ALLOWLIST is set to a comma-separated list of plugin names,
+// only those are allowed. If it's unset or empty, all plugins are.
+func pluginAllowed(name string) bool {
+	allowlist := os.Getenv("AGE_PLUGIN_ALLOWLIST")
+	if allowlist == "" {
+		return true
+	}
+	for _, n := range strings.Split(allowlist, ",") {
+		if strings.TrimSpace(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// startPlugin executes the plugin binary at path, resolving it in $PATH if
+// necessary, and returns a connection to it.
+func startPlugin(path, protocol string, opts options) (*clientConnection, error) {
+	if opts.verifyBinary != nil {
+		// Resolve the path once, so that the verified binary is the one that
+		// gets executed, even if $PATH changes.
+		p, err := exec.LookPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.verifyBinary(p); err != nil {
+			return nil, fmt.Errorf("plugin binary %q failed verification: %v", p, err)
+		}
+		path = p
+	}
+	cmd := exec.CommandContext(opts.ctx, path, "--age-plugin="+protocol)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -409,13 +619,16 @@ func openClientConnection(name, protocol string) (*clientConnection, error) {
 	}
 
 	cc := &clientConnection{
-		cmd:    cmd,
 		Reader: stdout,
 		Writer: stdin,
 		close: func() {
 			stdin.Close()
 			stdout.Close()
 		},
+		wait: func() error {
+			cmd.Process.Signal(os.Interrupt)
+			return cmd.Wait()
+		},
 	}
 
 	if os.Getenv("AGEDEBUG") == "plugin" {
@@ -426,8 +639,12 @@ func openClientConnection(name, protocol string) (*clientConnection, error) {
 
 	// We don't want the plugins to rely on the working directory for anything
 	// as different clients might treat it differently, so we set it to an empty
-	// temporary directory.
+	// temporary directory. It can be overridden with $AGE_PLUGIN_DIR for systems
+	// where the temporary directory is restricted.
 	cmd.Dir = os.TempDir()
+	if dir := os.Getenv("AGE_PLUGIN_DIR"); dir != "" {
+		cmd.Dir = dir
+	}
 
 	if err := cmd.Start(); err != nil {
 		return nil, err
@@ -436,12 +653,81 @@ func openClientConnection(name, protocol string) (*clientConnection, error) {
 	return cc, nil
 }
 
+// runInProcess runs the protocol state machine of p in a goroutine, connected
+// to the returned connection with pipes. Once ctx is done, the pipes are closed.
+func runInProcess(ctx context.Context, p *Plugin, name, protocol string) (*clientConnection, error) {
+	if p.name != name {
+		return nil, fmt.Errorf("in-process plugin is %q, not %q", p.name, name)
+	}
+	var run func() int
+	switch protocol {
+	case "recipient-v1":
+		run = p.RecipientV1
+	case "identity-v1":
+		run = p.IdentityV1
+	default:
+		return nil, fmt.Errorf("unknown state machine %q", protocol)
+	}
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	exit := make(chan int, 1)
+	p.mu.Lock()
+	p.stdin, p.stdout, p.broken = stdinR, stdoutW, false
+	go func() {
+		defer p.mu.Unlock()
+		code := run()
+		// Unblock the client if it's still reading, like a process exit.
+		stdoutW.Close()
+		stdinR.Close()
+		exit <- code
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stdinW.Close()
+			stdoutR.Close()
+		case <-closed:
+		}
+	}()
+
+	cc := &clientConnection{
+		Reader: stdoutR,
+		Writer: stdinW,
+		close: func() {
+			stdinW.Close()
+			stdoutR.Close()
+			close(closed)
+		},
+		wait: func() error {
+			var code int
+			select {
+			case code = <-exit:
+			case <-ctx.Done():
+				// Don't wait for a plugin that's stuck outside the protocol.
+				// It will release p once it returns.
+				return ctx.Err()
+			}
+			if code != 0 {
+				return fmt.Errorf("plugin exited with code %d", code)
+			}
+			return nil
+		},
+	}
+	if os.Getenv("AGEDEBUG") == "plugin" {
+		cc.Reader = io.TeeReader(cc.Reader, os.Stderr)
+		cc.Writer = io.MultiWriter(cc.Writer, os.Stderr)
+	}
+	return cc, nil
+}
+
 func (cc *clientConnection) Close() error {
-	// Close stdin and stdout and send SIGINT (if supported) to the plugin,
-	// then wait for it to cleanup and exit.
+	// Close stdin and stdout and, for plugin binaries, send SIGINT (if
+	// supported), then wait for the plugin to cleanup and exit.
 	cc.close()
-	cc.cmd.Process.Signal(os.Interrupt)
-	return cc.cmd.Wait()
+	return cc.wait()
 }
 
 func writeStanza(conn io.Writer, t string, args ...string) error {
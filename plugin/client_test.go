@@ -8,11 +8,15 @@ package plugin
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"filippo.io/age"
 	"filippo.io/age/internal/bech32"
@@ -72,11 +76,36 @@ func TestMain(m *testing.M) {
 		default:
 			panic(os.Args[1])
 		}
+	case "age-plugin-testhang":
+		// Never answer, like a plugin waiting for a hardware token.
+		time.Sleep(time.Hour)
+		os.Exit(1)
+	case "age-plugin-testconfirm":
+		p, _ := New("testconfirm")
+		p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+			return &confirmRecipient{p: p}, nil
+		})
+		os.Exit(p.Main())
 	default:
 		os.Exit(m.Run())
 	}
 }
 
+type confirmRecipient struct {
+	p *Plugin
+}
+
+func (r *confirmRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	yes, err := r.p.Confirm("encrypt to production key?", "yes", "no")
+	if err != nil {
+		return nil, err
+	}
+	if !yes {
+		return nil, errors.New("user declined encryption")
+	}
+	return []*age.Stanza{{Type: "test", Body: fileKey}}, nil
+}
+
 func TestLabels(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("Windows support is TODO")
@@ -131,3 +160,444 @@ func TestLabels(t *testing.T) {
 		t.Errorf("expected one pqc and one normal to fail")
 	}
 }
+
+func TestBinaryVerifier(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bech32.Encode("age1test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var verified []string
+	accept := WithBinaryVerifier(func(path string) error {
+		verified = append(verified, path)
+		return nil
+	})
+	r, err := NewRecipient(name, &ClientUI{}, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(verified) != 1 || verified[0] != filepath.Join(temp, "age-plugin-test") {
+		t.Errorf("unexpected verified paths: %q", verified)
+	}
+
+	errReject := errors.New("untrusted binary")
+	reject := WithBinaryVerifier(func(path string) error { return errReject })
+	r, err = NewRecipient(name, &ClientUI{}, reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Error("expected rejected plugin to fail")
+	} else if !strings.Contains(err.Error(), errReject.Error()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testconfirm")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(temp, "age-plugin-testconfirm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bech32.Encode("age1testconfirm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prompts []string
+	answer := true
+	ui := &ClientUI{
+		Confirm: func(name, prompt, yes, no string) (bool, error) {
+			prompts = append(prompts, prompt)
+			return answer, nil
+		},
+	}
+	r, err := NewRecipient(name, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(prompts) != 1 || prompts[0] != "encrypt to production key?" {
+		t.Errorf("unexpected prompts: %q", prompts)
+	}
+
+	answer = false
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Error("expected declined confirmation to fail")
+	} else if !strings.Contains(err.Error(), "user declined encryption") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Without a Confirm callback, the client fails the request and the
+	// plugin aborts cleanly.
+	r, err = NewRecipient(name, &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Error("expected failed confirmation to fail")
+	} else if !strings.Contains(err.Error(), "client failed to request confirmation") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStartRetries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The binary is copied rather than linked, since it's not executable yet.
+	binary := filepath.Join(temp, "age-plugin-test")
+	if err := os.WriteFile(binary, ex, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := bech32.Encode("age1test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRecipient(name, &ClientUI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); err == nil {
+		t.Fatal("expected non-executable plugin to fail")
+	} else if e := new(NotFoundError); errors.As(err, &e) {
+		t.Errorf("non-executable plugin reported as not found: %v", err)
+	}
+
+	r, err = NewRecipient(name, &ClientUI{}, WithStartRetries(10, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.Chmod(binary, 0755)
+	}()
+	if _, err := age.Encrypt(io.Discard, r); err != nil {
+		t.Errorf("expected retries to succeed, got %v", err)
+	}
+
+	missing, err := bech32.Encode("age1missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewRecipient(missing, &ClientUI{}, WithStartRetries(10, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Wrap(make([]byte, 16)); err == nil {
+		t.Error("expected missing plugin to fail")
+	} else if e := new(NotFoundError); !errors.As(err, &e) || e.Name != "missing" {
+		t.Errorf("expected NotFoundError for missing plugin, got %v", err)
+	}
+}
+
+type inProcessRecipient struct {
+	p *Plugin
+	r age.Recipient
+}
+
+func (r *inProcessRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	yes, err := r.p.Confirm("encrypt?", "yes", "no")
+	if err != nil {
+		return nil, err
+	}
+	if !yes {
+		return nil, errors.New("user declined encryption")
+	}
+	return r.r.Wrap(fileKey)
+}
+
+func TestInProcess(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New("inproc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		if string(data) != "public" {
+			return nil, errors.New("unknown recipient")
+		}
+		return &inProcessRecipient{p: p, r: id.Recipient()}, nil
+	})
+	p.HandleIdentity(func(data []byte) (age.Identity, error) {
+		if string(data) != "secret" {
+			return nil, errors.New("unknown identity")
+		}
+		return id, nil
+	})
+
+	answer := true
+	ui := &ClientUI{
+		Confirm: func(name, prompt, yes, no string) (bool, error) {
+			return answer, nil
+		},
+	}
+	r, err := NewRecipient(EncodeRecipient("inproc", []byte("public")), ui, WithInProcess(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := NewIdentity(EncodeIdentity("inproc", []byte("secret")), ui, WithInProcess(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &strings.Builder{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(strings.NewReader(buf.String()), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(out); err != nil || string(b) != "hello" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	// The same Plugin can be reused, and its errors reach the client.
+	answer = false
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Error("expected declined confirmation to fail")
+	} else if !strings.Contains(err.Error(), "user declined encryption") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	r, err = NewRecipient(EncodeRecipient("inproc", []byte("other")), ui, WithInProcess(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Error("expected unknown recipient to fail")
+	} else if !strings.Contains(err.Error(), "unknown recipient") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	r, err = NewRecipient(EncodeRecipient("other", []byte("public")), ui, WithInProcess(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.Encrypt(io.Discard, r); err == nil {
+		t.Error("expected mismatched plugin name to fail")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows support is TODO")
+	}
+	temp := t.TempDir()
+	testOnlyPluginPath = temp
+	t.Cleanup(func() { testOnlyPluginPath = "" })
+	ex, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ex, filepath.Join(temp, "age-plugin-testhang")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	i, err := NewIdentityWithoutData("testhang", &ClientUI{}, WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzas := []*age.Stanza{{Type: "test", Body: make([]byte, 16)}}
+	if _, err := i.Unwrap(stanzas); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the plugin binary to be stopped, got %v", err)
+	}
+
+	p, err := New("inproc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	p.HandleIdentity(func(data []byte) (age.Identity, error) {
+		return age.IdentityFunc(func([]*age.Stanza) ([]byte, error) {
+			cancel()
+			<-release
+			return nil, age.ErrIncorrectIdentity
+		}), nil
+	})
+	i, err = NewIdentityWithoutData("inproc", &ClientUI{}, WithInProcess(p), WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Unwrap(stanzas); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the in-process plugin to be stopped, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New("batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The plugin parses all recipients before wrapping the file key, so
+	// parsed shows how many recipients were sent to the same process.
+	var parsed, parsedAtWrap int
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		if string(data) == "bad" {
+			return nil, errors.New("unknown recipient")
+		}
+		parsed++
+		return &batchRecipient{r: id.Recipient(), parsed: &parsed, parsedAtWrap: &parsedAtWrap}, nil
+	})
+	p.HandleIdentity(func(data []byte) (age.Identity, error) {
+		switch string(data) {
+		case "secret":
+			return id, nil
+		case "other":
+			other, err := age.GenerateX25519Identity()
+			if err != nil {
+				return nil, err
+			}
+			return other, nil
+		default:
+			return nil, errors.New("unknown identity")
+		}
+	})
+
+	newRecipient := func(name, data string) *Recipient {
+		r, err := NewRecipient(EncodeRecipient(name, []byte(data)), &ClientUI{}, WithInProcess(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	newIdentity := func(name, data string) *Identity {
+		i, err := NewIdentity(EncodeIdentity(name, []byte(data)), &ClientUI{}, WithInProcess(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	x25519, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := BatchRecipients([]age.Recipient{
+		newRecipient("batch", "one"), x25519.Recipient(), newRecipient("batch", "two"),
+	})
+	if len(recipients) != 2 {
+		t.Fatalf("got %d batched recipients, want 2", len(recipients))
+	}
+	if _, ok := recipients[1].(*age.X25519Recipient); !ok {
+		t.Errorf("non-plugin recipient was not preserved, got %T", recipients[1])
+	}
+	buf := &strings.Builder{}
+	w, err := age.Encrypt(buf, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if parsedAtWrap != 2 {
+		t.Errorf("plugin received %d recipients at once, want 2", parsedAtWrap)
+	}
+
+	identities := BatchIdentities([]age.Identity{
+		newIdentity("batch", "other"), newIdentity("batch", "secret"),
+	})
+	if len(identities) != 1 {
+		t.Fatalf("got %d batched identities, want 1", len(identities))
+	}
+	out, err := age.Decrypt(strings.NewReader(buf.String()), identities...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(out); err != nil || string(b) != "hello" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	// Errors point back to the original position of the recipient or identity.
+	recipients = BatchRecipients([]age.Recipient{
+		x25519.Recipient(), newRecipient("batch", "one"), newRecipient("batch", "bad"),
+	})
+	if _, err := age.Encrypt(io.Discard, recipients...); err == nil {
+		t.Error("expected unknown recipient to fail")
+	} else if !strings.Contains(err.Error(), "recipient #2: unknown recipient") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	unrelated, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities = BatchIdentities([]age.Identity{
+		unrelated, newIdentity("batch", "secret"), newIdentity("batch", "bad"),
+	})
+	if _, err := age.Decrypt(strings.NewReader(buf.String()), identities...); err == nil {
+		t.Error("expected unknown identity to fail")
+	} else if !strings.Contains(err.Error(), "identity #2: unknown identity") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type batchRecipient struct {
+	r                    age.Recipient
+	parsed, parsedAtWrap *int
+}
+
+func (r *batchRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	if *r.parsedAtWrap == 0 {
+		*r.parsedAtWrap = *r.parsed
+	}
+	return r.r.Wrap(fileKey)
+}
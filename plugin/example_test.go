@@ -0,0 +1,48 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin_test
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"filippo.io/age"
+	"filippo.io/age/plugin"
+)
+
+// confirmRecipient wraps another Recipient, asking the user for confirmation
+// through the client before each use.
+type confirmRecipient struct {
+	p *plugin.Plugin
+	r age.Recipient
+}
+
+func (c *confirmRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	yes, err := c.p.Confirm("encrypt to the production key?", "yes", "no")
+	if err != nil {
+		return nil, err
+	}
+	if !yes {
+		// The error is sent to the client, which returns it from Encrypt.
+		return nil, errors.New("encryption declined by the user")
+	}
+	return c.r.Wrap(fileKey)
+}
+
+func ExamplePlugin_Confirm() {
+	p, err := plugin.New("example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		r, err := age.NewX25519RecipientFromPoint(data)
+		if err != nil {
+			return nil, err
+		}
+		return &confirmRecipient{p: p, r: r}, nil
+	})
+	os.Exit(p.Main())
+}
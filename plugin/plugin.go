@@ -0,0 +1,676 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+)
+
+// Plugin is a framework for writing age plugins. It allows exposing regular
+// age.Recipient and age.Identity implementations as plugins, and handles all
+// the protocol details.
+type Plugin struct {
+	name          string
+	fs            *flag.FlagSet
+	sm            *string
+	recipient     func([]byte) (age.Recipient, error)
+	idAsRecipient func([]byte) (age.Recipient, error)
+	identity      func([]byte) (age.Identity, error)
+	identityOrder func([]age.Identity, []*age.Stanza) []age.Identity
+	keygen        func() (identity, recipient string, err error)
+	keygenFlag    *bool
+
+	labelsRequired bool
+
+	stdin  io.Reader
+	stdout io.Writer
+	sr     *format.StanzaReader
+
+	// broken is set if the protocol broke down during an interaction function
+	// called by a Recipient or Identity.
+	broken bool
+
+	// mu is held while the plugin is run by a client with WithInProcess.
+	mu sync.Mutex
+}
+
+// New creates a new Plugin with the given name.
+//
+// For example, a plugin named "frood" would be invoked as "age-plugin-frood".
+func New(name string) (*Plugin, error) {
+	if !validPluginName(name) {
+		return nil, fmt.Errorf("invalid plugin name: %q", name)
+	}
+	return &Plugin{name: name, stdin: os.Stdin, stdout: os.Stdout}, nil
+}
+
+// Name returns the name of the plugin.
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// RegisterFlags registers the plugin's flags with the given flag.FlagSet, or
+// with the default flag.CommandLine if fs is nil. It must be called before
+// flag.Parse and Main.
+//
+// This allows the plugin to expose additional flags when invoked manually, for
+// example to implement a keygen mode.
+func (p *Plugin) RegisterFlags(fs *flag.FlagSet) {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	p.fs = fs
+	p.sm = fs.String("age-plugin", "", "age-plugin state machine")
+	if p.keygen != nil {
+		p.registerKeygenFlag()
+	}
+}
+
+func (p *Plugin) registerKeygenFlag() {
+	p.keygenFlag = p.fs.Bool("keygen", false, "generate a new identity")
+}
+
+// HandleRecipient registers a function to parse recipients of the form
+// age1name1... into age.Recipient values. data is the decoded Bech32 payload.
+//
+// If the returned Recipient implements age.RecipientWithLabels, Plugin will use
+// WrapWithLabels instead of Wrap.
+//
+// It must be called before Main, and can be called at most once.
+func (p *Plugin) HandleRecipient(f func(data []byte) (age.Recipient, error)) {
+	if p.recipient != nil {
+		panic("HandleRecipient called twice")
+	}
+	p.recipient = f
+}
+
+// HandleIdentityAsRecipient registers a function to parse identities of the
+// form AGE-PLUGIN-NAME-1... into age.Recipient values, for when identities are
+// used as recipients. data is the decoded Bech32 payload.
+//
+// If the returned Recipient implements age.RecipientWithLabels, Plugin will use
+// WrapWithLabels instead of Wrap.
+//
+// It must be called before Main, and can be called at most once.
+func (p *Plugin) HandleIdentityAsRecipient(f func(data []byte) (age.Recipient, error)) {
+	if p.idAsRecipient != nil {
+		panic("HandleIdentityAsRecipient called twice")
+	}
+	p.idAsRecipient = f
+}
+
+// HandleIdentity registers a function to parse identities of the form
+// AGE-PLUGIN-NAME-1... into age.Identity values. data is the decoded Bech32
+// payload.
+//
+// It must be called before Main, and can be called at most once.
+func (p *Plugin) HandleIdentity(f func(data []byte) (age.Identity, error)) {
+	if p.identity != nil {
+		panic("HandleIdentity called twice")
+	}
+	p.identity = f
+}
+
+// HandleIdentityOrder registers a function to choose the order in which
+// IdentityV1 tries the identities on the stanzas of each file. f receives the
+// identities in the order the client provided them, and the file's stanzas,
+// and returns the identities to try, in order. It may omit identities that
+// can't match, for example because the hardware token they live on is not
+// connected.
+//
+// Identities are tried in the plugin, so this requires no support from the
+// client. Without an order function, identities are tried in the order the
+// client provided them.
+//
+// It must be called before Main, and can be called at most once.
+func (p *Plugin) HandleIdentityOrder(f func(identities []age.Identity, stanzas []*age.Stanza) []age.Identity) {
+	if p.identityOrder != nil {
+		panic("HandleIdentityOrder called twice")
+	}
+	p.identityOrder = f
+}
+
+// HandleKeygen registers a function to generate a new identity, invoked when
+// the plugin is run with the -keygen flag (or --keygen). Main prints the
+// returned identity encoding, preceded by "# created:" and "# recipient:"
+// comments, to standard output in the same format as age-keygen.
+//
+// It must be called before Main, and before parsing the flags if
+// RegisterFlags was called explicitly. It can be called at most once.
+func (p *Plugin) HandleKeygen(f func() (identity, recipient string, err error)) {
+	if p.keygen != nil {
+		panic("HandleKeygen called twice")
+	}
+	p.keygen = f
+	if p.fs != nil {
+		p.registerKeygenFlag()
+	}
+}
+
+// RequireLabels makes RecipientV1 fail if the recipients return any labels
+// (see age.RecipientWithLabels) but the client doesn't support the labels
+// extension, instead of silently dropping them.
+//
+// Labels are used to enforce security properties, such as preventing the mix
+// of post-quantum and classic recipients, which older clients can't enforce.
+//
+// It must be called before Main.
+func (p *Plugin) RequireLabels() {
+	p.labelsRequired = true
+}
+
+// Main runs the plugin protocol over standard input and output, and returns an
+// exit code to pass to os.Exit. It should be called by the main function of
+// the plugin binary, after the Handle methods.
+//
+// If RegisterFlags was not called, Main registers and parses the plugin flags
+// with flag.CommandLine.
+func (p *Plugin) Main() int {
+	if p.fs == nil {
+		p.RegisterFlags(nil)
+	}
+	if !p.fs.Parsed() {
+		p.fs.Parse(os.Args[1:])
+	}
+	if p.keygenFlag != nil && *p.keygenFlag {
+		if *p.sm != "" {
+			return fatalf("-keygen can't be used with -age-plugin")
+		}
+		return p.Keygen()
+	}
+	switch *p.sm {
+	case "recipient-v1":
+		return p.RecipientV1()
+	case "identity-v1":
+		return p.IdentityV1()
+	default:
+		return fatalf("unknown state machine %q", *p.sm)
+	}
+}
+
+// Keygen generates a new identity with the function registered by
+// HandleKeygen and prints it to standard output, and returns an exit code to
+// pass to os.Exit.
+//
+// Most plugins should call Main instead of this method.
+func (p *Plugin) Keygen() int {
+	if p.keygen == nil {
+		return fatalf("keygen not supported")
+	}
+	identity, recipient, err := p.keygen()
+	if err != nil {
+		return fatalf("failed to generate identity: %v", err)
+	}
+	fmt.Fprintf(p.stdout, "# created: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(p.stdout, "# recipient: %s\n", recipient)
+	if _, err := fmt.Fprintf(p.stdout, "%s\n", identity); err != nil {
+		return fatalf("failed to write identity: %v", err)
+	}
+	return 0
+}
+
+// RecipientV1 implements the recipient-v1 state machine over standard input
+// and output, and returns an exit code to pass to os.Exit.
+//
+// All recipients must return the same set of labels (in any order) for all
+// file keys, otherwise RecipientV1 fails with an internal error.
+//
+// Most plugins should call Main instead of this method.
+func (p *Plugin) RecipientV1() int {
+	if p.recipient == nil && p.idAsRecipient == nil {
+		return fatalf("recipient-v1 not supported")
+	}
+
+	var recipientStrings, identityStrings []string
+	var fileKeys [][]byte
+	var supportsLabels bool
+
+	p.sr = format.NewStanzaReader(bufio.NewReader(p.stdin))
+ReadLoop:
+	for {
+		s, err := p.sr.ReadStanza()
+		if err != nil {
+			return fatalf("failed to read stanza: %v", err)
+		}
+
+		switch s.Type {
+		case "add-recipient":
+			if err := expectArgs(s, 1); err != nil {
+				return fatalf("%v", err)
+			}
+			recipientStrings = append(recipientStrings, s.Args[0])
+		case "add-identity":
+			if err := expectArgs(s, 1); err != nil {
+				return fatalf("%v", err)
+			}
+			identityStrings = append(identityStrings, s.Args[0])
+		case "wrap-file-key":
+			if err := expectArgs(s, 0); err != nil {
+				return fatalf("%v", err)
+			}
+			fileKeys = append(fileKeys, s.Body)
+		case "extension-labels":
+			if err := expectArgs(s, 0); err != nil {
+				return fatalf("%v", err)
+			}
+			supportsLabels = true
+		case "done":
+			if err := expectArgs(s, 0); err != nil {
+				return fatalf("%v", err)
+			}
+			break ReadLoop
+		default:
+			// Unsupported stanzas in uni-directional phases are ignored.
+		}
+	}
+
+	if len(recipientStrings)+len(identityStrings) == 0 {
+		return fatalf("no recipients or identities provided")
+	}
+	if len(fileKeys) == 0 {
+		return fatalf("no file keys provided")
+	}
+
+	var recipients, identities []age.Recipient
+	for i, s := range recipientStrings {
+		name, data, err := ParseRecipient(s)
+		if err != nil {
+			return p.recipientError(i, err)
+		}
+		if name != p.name {
+			return p.recipientError(i, fmt.Errorf("unsupported plugin name: %q", name))
+		}
+		if p.recipient == nil {
+			return p.recipientError(i, errors.New("recipient encodings not supported"))
+		}
+		r, err := p.recipient(data)
+		if err != nil {
+			return p.recipientError(i, err)
+		}
+		recipients = append(recipients, r)
+	}
+	for i, s := range identityStrings {
+		name, data, err := ParseIdentity(s)
+		if err != nil {
+			return p.identityError(i, err)
+		}
+		if name != p.name {
+			return p.identityError(i, fmt.Errorf("unsupported plugin name: %q", name))
+		}
+		if p.idAsRecipient == nil {
+			return p.identityError(i, errors.New("identity encodings not supported"))
+		}
+		r, err := p.idAsRecipient(data)
+		if err != nil {
+			return p.identityError(i, err)
+		}
+		identities = append(identities, r)
+	}
+
+	// Technically labels should be per-file key, but the client-side protocol
+	// extension shipped like this, and it doesn't feel worth making a v2.
+	var labels []string
+
+	stanzas := make([][]*age.Stanza, len(fileKeys))
+	for i, fk := range fileKeys {
+		for j, r := range append(recipients, identities...) {
+			ss, ll, err := wrapWithLabels(r, fk)
+			if p.broken {
+				return 2
+			} else if err != nil && j < len(recipients) {
+				return p.recipientError(j, err)
+			} else if err != nil {
+				return p.identityError(j-len(recipients), err)
+			}
+			// Labels are a set, so compare them in sorted order, without
+			// sorting the slice owned by the recipient.
+			ll = append([]string(nil), ll...)
+			sort.Strings(ll)
+			if i == 0 && j == 0 {
+				labels = ll
+			} else if !slicesEqual(labels, ll) {
+				return p.internalError(fmt.Errorf("labels %q and %q are not compatible", labels, ll))
+			}
+			stanzas[i] = append(stanzas[i], ss...)
+		}
+	}
+
+	if supportsLabels {
+		if err := writeStanza(p.stdout, "labels", labels...); err != nil {
+			return fatalf("failed to write labels stanza: %v", err)
+		}
+		if err := expectOk(p.sr); err != nil {
+			return fatalf("%v", err)
+		}
+	} else if len(labels) > 0 && p.labelsRequired {
+		return p.internalError(errors.New("the client does not support labels, which are required by this plugin; please update it"))
+	}
+
+	for i, ss := range stanzas {
+		for _, s := range ss {
+			if err := (&format.Stanza{Type: "recipient-stanza",
+				Args: append([]string{strconv.Itoa(i), s.Type}, s.Args...),
+				Body: s.Body}).Marshal(p.stdout); err != nil {
+				return fatalf("failed to write recipient-stanza: %v", err)
+			}
+			if err := expectOk(p.sr); err != nil {
+				return fatalf("%v", err)
+			}
+		}
+	}
+
+	if err := writeStanza(p.stdout, "done"); err != nil {
+		return fatalf("failed to write done stanza: %v", err)
+	}
+	return 0
+}
+
+// IdentityV1 implements the identity-v1 state machine over standard input and
+// output, and returns an exit code to pass to os.Exit.
+//
+// Most plugins should call Main instead of this method.
+func (p *Plugin) IdentityV1() int {
+	if p.identity == nil {
+		return fatalf("identity-v1 not supported")
+	}
+
+	var files [][]*age.Stanza
+	var identityStrings []string
+
+	p.sr = format.NewStanzaReader(bufio.NewReader(p.stdin))
+ReadLoop:
+	for {
+		s, err := p.sr.ReadStanza()
+		if err != nil {
+			return fatalf("failed to read stanza: %v", err)
+		}
+
+		switch s.Type {
+		case "add-identity":
+			if err := expectArgs(s, 1); err != nil {
+				return fatalf("%v", err)
+			}
+			identityStrings = append(identityStrings, s.Args[0])
+		case "recipient-stanza":
+			if len(s.Args) < 2 {
+				return fatalf("recipient-stanza stanza has %d arguments, want at least 2", len(s.Args))
+			}
+			i, err := strconv.Atoi(s.Args[0])
+			if err != nil {
+				return fatalf("failed to parse recipient-stanza stanza argument: %v", err)
+			}
+			ss := &age.Stanza{Type: s.Args[1], Args: s.Args[2:], Body: s.Body}
+			switch i {
+			case len(files):
+				files = append(files, []*age.Stanza{ss})
+			case len(files) - 1:
+				files[len(files)-1] = append(files[len(files)-1], ss)
+			default:
+				return fatalf("unexpected file index %d, previous was %d", i, len(files)-1)
+			}
+		case "done":
+			if err := expectArgs(s, 0); err != nil {
+				return fatalf("%v", err)
+			}
+			break ReadLoop
+		default:
+			// Unsupported stanzas in uni-directional phases are ignored.
+		}
+	}
+
+	if len(identityStrings) == 0 {
+		return fatalf("no identities provided")
+	}
+	if len(files) == 0 {
+		return fatalf("no stanzas provided")
+	}
+
+	var identities []age.Identity
+	for i, s := range identityStrings {
+		name, data, err := ParseIdentity(s)
+		if err != nil {
+			return p.identityError(i, err)
+		}
+		if name != p.name {
+			return p.identityError(i, fmt.Errorf("unsupported plugin name: %q", name))
+		}
+		id, err := p.identity(data)
+		if err != nil {
+			return p.identityError(i, err)
+		}
+		identities = append(identities, id)
+	}
+
+FilesLoop:
+	for i, ss := range files {
+		ids := identities
+		if p.identityOrder != nil {
+			ids = p.identityOrder(append([]age.Identity(nil), identities...), ss)
+		}
+		for _, id := range ids {
+			fk, err := id.Unwrap(ss)
+			if p.broken {
+				return 2
+			} else if errors.Is(err, age.ErrIncorrectIdentity) {
+				continue
+			} else if err != nil {
+				if code := p.writeError([]string{"stanza", strconv.Itoa(i), "0"}, err); code != 0 {
+					return code
+				}
+				continue FilesLoop
+			}
+
+			s := &format.Stanza{Type: "file-key", Args: []string{strconv.Itoa(i)}, Body: fk}
+			if err := s.Marshal(p.stdout); err != nil {
+				return fatalf("failed to write file-key: %v", err)
+			}
+			if err := expectOk(p.sr); err != nil {
+				return fatalf("%v", err)
+			}
+			continue FilesLoop
+		}
+	}
+
+	if err := writeStanza(p.stdout, "done"); err != nil {
+		return fatalf("failed to write done stanza: %v", err)
+	}
+	return 0
+}
+
+// DisplayMessage requests that the client display a message to the user. The
+// message should start with a lowercase letter and have no final period.
+// DisplayMessage returns an error if the client can't display the message, and
+// may return before the message has been displayed to the user.
+//
+// It must only be called by a Wrap or Unwrap method invoked by Main.
+func (p *Plugin) DisplayMessage(message string) error {
+	if err := writeStanzaWithBody(p.stdout, "msg", []byte(message)); err != nil {
+		return p.fatalInteractivef("failed to write msg stanza: %v", err)
+	}
+	s, err := readOkOrFail(p.sr)
+	if err != nil {
+		return p.fatalInteractivef("%v", err)
+	}
+	if s.Type == "fail" {
+		return errors.New("client failed to display message")
+	}
+	if err := expectArgs(s, 0); err != nil {
+		return p.fatalInteractivef("%v", err)
+	}
+	return nil
+}
+
+// RequestValue requests a secret or public input from the user through the
+// client, with the provided prompt. It returns an error if the client can't
+// request the input or if the user dismisses the prompt.
+//
+// It must only be called by a Wrap or Unwrap method invoked by Main.
+func (p *Plugin) RequestValue(prompt string, secret bool) (string, error) {
+	t := "request-public"
+	if secret {
+		t = "request-secret"
+	}
+	if err := writeStanzaWithBody(p.stdout, t, []byte(prompt)); err != nil {
+		return "", p.fatalInteractivef("failed to write %s stanza: %v", t, err)
+	}
+	s, err := readOkOrFail(p.sr)
+	if err != nil {
+		return "", p.fatalInteractivef("%v", err)
+	}
+	if s.Type == "fail" {
+		return "", errors.New("client failed to request value")
+	}
+	if err := expectArgs(s, 0); err != nil {
+		return "", p.fatalInteractivef("%v", err)
+	}
+	return string(s.Body), nil
+}
+
+// Confirm requests a confirmation from the user through the client, with the
+// provided prompt. The yes and no value are the choices provided to the user.
+// no may be empty. The return value choseYes indicates whether the user
+// selected the yes or no option. Confirm returns an error if the client can't
+// request the confirmation.
+//
+// It must only be called by a Wrap or Unwrap method invoked by Main.
+//
+// To abort an operation if the user declines, Wrap or Unwrap can simply return
+// an error, which will be sent to the client and returned by Encrypt or
+// Decrypt. If instead the protocol broke down, Main exits regardless of what
+// Wrap or Unwrap return.
+func (p *Plugin) Confirm(prompt, yes, no string) (choseYes bool, err error) {
+	args := []string{format.EncodeToString([]byte(yes))}
+	if no != "" {
+		args = append(args, format.EncodeToString([]byte(no)))
+	}
+	s := &format.Stanza{Type: "confirm", Args: args, Body: []byte(prompt)}
+	if err := s.Marshal(p.stdout); err != nil {
+		return false, p.fatalInteractivef("failed to write confirm stanza: %v", err)
+	}
+	s, err = readOkOrFail(p.sr)
+	if err != nil {
+		return false, p.fatalInteractivef("%v", err)
+	}
+	if s.Type == "fail" {
+		return false, errors.New("client failed to request confirmation")
+	}
+	if err := expectArgs(s, 1); err != nil {
+		return false, p.fatalInteractivef("%v", err)
+	}
+	switch s.Args[0] {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, p.fatalInteractivef("unexpected confirm response: %q", s.Args[0])
+	}
+}
+
+// fatalInteractivef prints the error to stderr and sets the broken flag, so the
+// Wrap/Unwrap caller can exit with an error.
+func (p *Plugin) fatalInteractivef(format string, args ...interface{}) error {
+	p.broken = true
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	return fmt.Errorf(format, args...)
+}
+
+func fatalf(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	return 1
+}
+
+func (p *Plugin) recipientError(idx int, err error) int {
+	return p.writeError([]string{"recipient", strconv.Itoa(idx)}, err)
+}
+
+func (p *Plugin) identityError(idx int, err error) int {
+	return p.writeError([]string{"identity", strconv.Itoa(idx)}, err)
+}
+
+func (p *Plugin) internalError(err error) int {
+	return p.writeError([]string{"internal"}, err)
+}
+
+// writeError sends an error stanza to the client and waits for its
+// acknowledgement. It returns 3, or 1 if the protocol broke down.
+func (p *Plugin) writeError(args []string, err error) int {
+	s := &format.Stanza{Type: "error", Args: args, Body: []byte(err.Error())}
+	if err := s.Marshal(p.stdout); err != nil {
+		return fatalf("failed to write error stanza: %v", err)
+	}
+	if err := expectOk(p.sr); err != nil {
+		return fatalf("%v", err)
+	}
+	return 3
+}
+
+func expectArgs(s *format.Stanza, n int) error {
+	if len(s.Args) != n {
+		return fmt.Errorf("%s stanza has %d arguments, want %d", s.Type, len(s.Args), n)
+	}
+	return nil
+}
+
+func expectOk(sr *format.StanzaReader) error {
+	ok, err := sr.ReadStanza()
+	if err != nil {
+		return fmt.Errorf("failed to read OK stanza: %v", err)
+	}
+	if ok.Type != "ok" {
+		return fmt.Errorf("expected OK stanza, got %q", ok.Type)
+	}
+	return expectArgs(ok, 0)
+}
+
+func readOkOrFail(sr *format.StanzaReader) (*format.Stanza, error) {
+	s, err := sr.ReadStanza()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response stanza: %v", err)
+	}
+	switch s.Type {
+	case "fail":
+		if err := expectArgs(s, 0); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "ok":
+		return s, nil
+	default:
+		return nil, fmt.Errorf("expected ok or fail stanza, got %q", s.Type)
+	}
+}
+
+func wrapWithLabels(r age.Recipient, fileKey []byte) (s []*age.Stanza, labels []string, err error) {
+	if r, ok := r.(age.RecipientWithLabels); ok {
+		return r.WrapWithLabels(fileKey)
+	}
+	s, err = r.Wrap(fileKey)
+	return
+}
+
+func slicesEqual(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,326 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/internal/format"
+)
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{"", "te st", "te/st", "té"} {
+		if _, err := New(name); err == nil {
+			t.Errorf("New(%q): expected an error", name)
+		}
+	}
+	p, err := New("Test-1.2+3_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() != "Test-1.2+3_" {
+		t.Errorf("got name %q", p.Name())
+	}
+}
+
+type bodyRecipient struct{ data []byte }
+
+func (r bodyRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{{Type: "test", Args: []string{string(r.data)}, Body: fileKey}}, nil
+}
+
+func TestRecipientV1(t *testing.T) {
+	p, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		return bodyRecipient{data}, nil
+	})
+
+	in := &bytes.Buffer{}
+	writeStanza(in, "add-recipient", EncodeRecipient("test", []byte("a")))
+	writeStanza(in, "add-recipient", EncodeRecipient("test", []byte("b")))
+	writeStanzaWithBody(in, "wrap-file-key", make([]byte, 16))
+	writeStanzaWithBody(in, "wrap-file-key", bytes.Repeat([]byte{1}, 16))
+	writeStanza(in, "done")
+	for i := 0; i < 4; i++ {
+		writeStanza(in, "ok")
+	}
+	out := &bytes.Buffer{}
+	p.stdin, p.stdout = in, out
+
+	if code := p.RecipientV1(); code != 0 {
+		t.Fatalf("got exit code %d, output %q", code, out)
+	}
+	want := "-> recipient-stanza 0 test a\nAAAAAAAAAAAAAAAAAAAAAA\n" +
+		"-> recipient-stanza 0 test b\nAAAAAAAAAAAAAAAAAAAAAA\n" +
+		"-> recipient-stanza 1 test a\nAQEBAQEBAQEBAQEBAQEBAQ\n" +
+		"-> recipient-stanza 1 test b\nAQEBAQEBAQEBAQEBAQEBAQ\n" +
+		"-> done\n\n"
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out, want)
+	}
+}
+
+func TestIdentityV1Errors(t *testing.T) {
+	run := func(in *bytes.Buffer) (int, string) {
+		p, err := New("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.HandleIdentity(func(data []byte) (age.Identity, error) {
+			return age.GenerateX25519Identity()
+		})
+		out := &bytes.Buffer{}
+		p.stdin, p.stdout = in, out
+		return p.IdentityV1(), out.String()
+	}
+
+	in := &bytes.Buffer{}
+	writeStanza(in, "add-identity", EncodeIdentity("test", nil))
+	writeStanza(in, "add-identity", EncodeIdentity("other", nil))
+	(&format.Stanza{Type: "recipient-stanza", Args: []string{"0", "X25519", "x"}}).Marshal(in)
+	writeStanza(in, "done")
+	writeStanza(in, "ok")
+	code, out := run(in)
+	if code != 3 {
+		t.Errorf("wrong plugin name: got exit code %d, want 3", code)
+	}
+	if !strings.HasPrefix(out, "-> error identity 1\n") {
+		t.Errorf("wrong plugin name: expected an identity error, got %q", out)
+	}
+
+	in = &bytes.Buffer{}
+	(&format.Stanza{Type: "recipient-stanza", Args: []string{"0", "X25519", "x"}}).Marshal(in)
+	writeStanza(in, "done")
+	if code, out := run(in); code != 1 || out != "" {
+		t.Errorf("no identities: got exit code %d and output %q, want 1", code, out)
+	}
+
+	in = &bytes.Buffer{}
+	writeStanza(in, "add-identity", EncodeIdentity("test", nil))
+	(&format.Stanza{Type: "recipient-stanza", Args: []string{"1", "X25519", "x"}}).Marshal(in)
+	writeStanza(in, "done")
+	if code, _ := run(in); code != 1 {
+		t.Errorf("out of order file index: got exit code %d, want 1", code)
+	}
+}
+
+type labelsRecipient struct{}
+
+func (labelsRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	panic("Wrap called instead of WrapWithLabels")
+}
+
+func (labelsRecipient) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	return []*age.Stanza{{Type: "test", Body: fileKey}}, []string{"postquantum"}, nil
+}
+
+func runRecipientV1(t *testing.T, requireLabels, clientLabels bool) (int, string) {
+	p, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		return labelsRecipient{}, nil
+	})
+	if requireLabels {
+		p.RequireLabels()
+	}
+
+	in := &bytes.Buffer{}
+	writeStanza(in, "add-recipient", EncodeRecipient("test", nil))
+	writeStanzaWithBody(in, "wrap-file-key", make([]byte, 16))
+	if clientLabels {
+		writeStanza(in, "extension-labels")
+	}
+	writeStanza(in, "done")
+	// The client replies ok to any command, so queue enough of them.
+	for i := 0; i < 3; i++ {
+		writeStanza(in, "ok")
+	}
+	out := &bytes.Buffer{}
+	p.stdin, p.stdout = in, out
+
+	return p.RecipientV1(), out.String()
+}
+
+func TestRequireLabels(t *testing.T) {
+	code, out := runRecipientV1(t, false, false)
+	if code != 0 {
+		t.Errorf("labels dropped: got exit code %d, output %q", code, out)
+	}
+	if strings.Contains(out, "-> labels") {
+		t.Errorf("labels sent to a client that doesn't support them: %q", out)
+	}
+
+	code, out = runRecipientV1(t, true, true)
+	if code != 0 {
+		t.Errorf("labels supported: got exit code %d, output %q", code, out)
+	}
+	if !strings.Contains(out, "-> labels postquantum\n") {
+		t.Errorf("labels not sent: %q", out)
+	}
+
+	code, out = runRecipientV1(t, true, false)
+	if code != 3 {
+		t.Errorf("labels required: got exit code %d, want 3", code)
+	}
+	if !strings.HasPrefix(out, "-> error internal\n") {
+		t.Errorf("labels required: expected internal error, got %q", out)
+	}
+	if strings.Contains(out, "recipient-stanza") {
+		t.Errorf("labels required: stanzas sent despite the error: %q", out)
+	}
+}
+
+// reorderingRecipient returns its labels in a different order at every call.
+type reorderingRecipient struct {
+	labels []string
+	calls  int
+}
+
+func (r *reorderingRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	panic("Wrap called instead of WrapWithLabels")
+}
+
+func (r *reorderingRecipient) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	r.calls++
+	labels := r.labels
+	if r.calls%2 == 0 {
+		labels = []string{r.labels[1], r.labels[0]}
+	}
+	return []*age.Stanza{{Type: "test", Body: fileKey}}, labels, nil
+}
+
+func TestLabelsOrder(t *testing.T) {
+	p, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := []string{"postquantum", "foo"}
+	p.HandleRecipient(func(data []byte) (age.Recipient, error) {
+		return &reorderingRecipient{labels: labels}, nil
+	})
+
+	in := &bytes.Buffer{}
+	writeStanza(in, "add-recipient", EncodeRecipient("test", []byte("a")))
+	writeStanza(in, "add-recipient", EncodeRecipient("test", []byte("b")))
+	writeStanzaWithBody(in, "wrap-file-key", make([]byte, 16))
+	writeStanzaWithBody(in, "wrap-file-key", make([]byte, 16))
+	writeStanza(in, "extension-labels")
+	writeStanza(in, "done")
+	for i := 0; i < 5; i++ {
+		writeStanza(in, "ok")
+	}
+	out := &bytes.Buffer{}
+	p.stdin, p.stdout = in, out
+
+	if code := p.RecipientV1(); code != 0 {
+		t.Fatalf("got exit code %d, output %q", code, out)
+	}
+	if !strings.Contains(out.String(), "-> labels foo postquantum\n") {
+		t.Errorf("labels not sent in sorted order: %q", out)
+	}
+	if labels[0] != "postquantum" {
+		t.Errorf("recipient labels were modified: %q", labels)
+	}
+}
+
+type namedIdentity struct {
+	name  string
+	tried *[]string
+}
+
+func (i namedIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	*i.tried = append(*i.tried, i.name)
+	if stanzas[0].Args[0] != i.name {
+		return nil, age.ErrIncorrectIdentity
+	}
+	return stanzas[0].Body, nil
+}
+
+func TestIdentityOrder(t *testing.T) {
+	p, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tried []string
+	p.HandleIdentity(func(data []byte) (age.Identity, error) {
+		return namedIdentity{name: string(data), tried: &tried}, nil
+	})
+	p.HandleIdentityOrder(func(ids []age.Identity, ss []*age.Stanza) []age.Identity {
+		// Try the identity named in the stanza first, and skip "c".
+		var first, rest []age.Identity
+		for _, id := range ids {
+			switch id.(namedIdentity).name {
+			case "c":
+			case ss[0].Args[0]:
+				first = append(first, id)
+			default:
+				rest = append(rest, id)
+			}
+		}
+		return append(first, rest...)
+	})
+
+	in := &bytes.Buffer{}
+	for _, name := range []string{"a", "b", "c"} {
+		writeStanza(in, "add-identity", EncodeIdentity("test", []byte(name)))
+	}
+	(&format.Stanza{Type: "recipient-stanza", Args: []string{"0", "test", "b"},
+		Body: make([]byte, 16)}).Marshal(in)
+	(&format.Stanza{Type: "recipient-stanza", Args: []string{"1", "test", "c"},
+		Body: make([]byte, 16)}).Marshal(in)
+	writeStanza(in, "done")
+	writeStanza(in, "ok")
+	out := &bytes.Buffer{}
+	p.stdin, p.stdout = in, out
+
+	if code := p.IdentityV1(); code != 0 {
+		t.Fatalf("got exit code %d, output %q", code, out)
+	}
+	if got, want := strings.Join(tried, ","), "b,a,b"; got != want {
+		t.Errorf("identities tried in order %q, want %q", got, want)
+	}
+	if !strings.Contains(out.String(), "-> file-key 0\n") ||
+		strings.Contains(out.String(), "-> file-key 1\n") {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestKeygen(t *testing.T) {
+	p, err := New("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := EncodeIdentity("test", []byte("secret"))
+	recipient := EncodeRecipient("test", []byte("public"))
+	p.HandleKeygen(func() (string, string, error) {
+		return identity, recipient, nil
+	})
+	fs := flag.NewFlagSet("age-plugin-test", flag.ContinueOnError)
+	p.RegisterFlags(fs)
+	if err := fs.Parse([]string{"--keygen"}); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	p.stdout = out
+
+	if code := p.Main(); code != 0 {
+		t.Fatalf("got exit code %d", code)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "# created: ") ||
+		lines[1] != "# recipient: "+recipient || lines[2] != identity || lines[3] != "" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import "fmt"
+
+const postQuantumLabel = "postquantum"
+
+// RequirePostQuantum checks that every recipient is post-quantum secure, and
+// returns recipients that enforce it when passed to Encrypt.
+//
+// A recipient is considered post-quantum if it's a ScryptRecipient, or if its
+// WrapWithLabels method (see RecipientWithLabels) returns the "postquantum"
+// label. Recipients that don't implement RecipientWithLabels, like
+// X25519Recipient and the agessh recipients, are rejected immediately. The
+// labels of the others, such as plugin recipients, are only known after
+// wrapping, so the returned recipients fail to Wrap if they are missing.
+func RequirePostQuantum(recipients ...Recipient) ([]Recipient, error) {
+	var guarded []Recipient
+	for i, r := range recipients {
+		switch r := r.(type) {
+		case *ScryptRecipient:
+			guarded = append(guarded, r)
+		case RecipientWithLabels:
+			guarded = append(guarded, &postQuantumRecipient{r})
+		default:
+			return nil, fmt.Errorf("recipient #%d of type %T is not post-quantum", i, r)
+		}
+	}
+	return guarded, nil
+}
+
+type postQuantumRecipient struct {
+	r RecipientWithLabels
+}
+
+func (p *postQuantumRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	s, _, err := p.WrapWithLabels(fileKey)
+	return s, err
+}
+
+func (p *postQuantumRecipient) WrapWithLabels(fileKey []byte) ([]*Stanza, []string, error) {
+	s, labels, err := p.r.WrapWithLabels(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, l := range labels {
+		if l == postQuantumLabel {
+			return s, labels, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("recipient of type %T is not post-quantum", p.r)
+}
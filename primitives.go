@@ -8,7 +8,9 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 
 	"filippo.io/age/internal/format"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -70,3 +72,52 @@ func streamKey(fileKey, nonce []byte) []byte {
 	}
 	return streamKey
 }
+
+const filenameLabel = "age-encryption.org/v1/filename"
+const filenameStanzaType = "filename"
+const maxFilenameSize = 255
+
+// filenameKey derives from the file key the one-time key used to encrypt the
+// body of the filename stanza.
+func filenameKey(fileKey []byte) []byte {
+	h := hkdf.New(sha256.New, fileKey, nil, []byte(filenameLabel))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return key
+}
+
+// decryptFilename decrypts the body of a filename stanza. Unlike aeadDecrypt,
+// the size of the plaintext is not fixed, but it's limited to maxFilenameSize.
+func decryptFilename(fileKey, body []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(filenameKey(fileKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxFilenameSize+aead.Overhead() {
+		return nil, errors.New("invalid filename stanza: filename too long")
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	name, err := aead.Open(nil, nonce, body, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt filename stanza")
+	}
+	return name, nil
+}
+
+// checkFilename checks that name is a plausible base name, which doesn't
+// traverse or name directories when joined to a directory path.
+func checkFilename(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty filename")
+	case len(name) > maxFilenameSize:
+		return errors.New("filename too long")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid filename %q", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("invalid filename %q: must be a base name", name)
+	}
+	return nil
+}
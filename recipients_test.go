@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"filippo.io/age"
+	"golang.org/x/crypto/nacl/box"
 )
 
 func TestX25519RoundTrip(t *testing.T) {
@@ -80,3 +81,45 @@ func TestScryptRoundTrip(t *testing.T) {
 		t.Errorf("invalid output: %x, expected %x", out, fileKey)
 	}
 }
+
+func TestX25519FromNaClBox(t *testing.T) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := age.NewX25519IdentityFromScalar(priv[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.NewX25519RecipientFromPoint(pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Recipient().String() != r.String() {
+		t.Errorf("identity recipient %q doesn't match box public key %q", i.Recipient(), r)
+	}
+
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	stanzas, err := r.Wrap(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := i.Unwrap(stanzas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fileKey, out) {
+		t.Errorf("invalid output: %x, expected %x", out, fileKey)
+	}
+
+	if _, err := age.NewX25519IdentityFromScalar(priv[:31]); err == nil {
+		t.Error("expected short scalar to fail")
+	}
+	if _, err := age.NewX25519RecipientFromPoint(append(pub[:], 0)); err == nil {
+		t.Error("expected long point to fail")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package age
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// builtinRecipientPrefixes and builtinIdentityPrefixes are the prefixes of the
+// encodings parsed natively by this module and by the age CLI, which can't be
+// shadowed by registered parsers.
+var builtinRecipientPrefixes = []string{"age1", "ssh-", "github:"}
+var builtinIdentityPrefixes = []string{"AGE-SECRET-KEY-1", "AGE-PLUGIN-", "-----BEGIN"}
+
+// builtinTypes are the recipient and identity types implemented by this
+// module, named after the stanzas they produce. Each of them has both a
+// recipient and an identity. They are implemented across the age, agessh, and
+// plugin packages.
+var builtinTypes = []string{"X25519", "scrypt", "ssh-rsa", "ssh-ed25519", "plugin"}
+
+var registry struct {
+	sync.RWMutex
+	recipients map[string]func(string) (Recipient, error)
+	identities map[string]func(string) (Identity, error)
+}
+
+// RegisterRecipientParser makes parse available to the age CLI (and to any
+// other user of LookupRecipientParser) for recipient encodings that start with
+// prefix. It's meant to be called from an init function by builds that add
+// their own recipient types.
+//
+// The encodings supported natively, such as "age1" and "ssh-", always take
+// precedence, so RegisterRecipientParser panics if prefix overlaps with one of
+// them, or with a previously registered prefix. Two prefixes overlap if either
+// is a prefix of the other. It also panics if prefix is empty or parse is nil.
+func RegisterRecipientParser(prefix string, parse func(string) (Recipient, error)) {
+	if parse == nil {
+		panic("age: RegisterRecipientParser called with nil parse function")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.recipients == nil {
+		registry.recipients = make(map[string]func(string) (Recipient, error))
+	}
+	var registered []string
+	for p := range registry.recipients {
+		registered = append(registered, p)
+	}
+	checkPrefix("RegisterRecipientParser", prefix, builtinRecipientPrefixes, registered)
+	registry.recipients[prefix] = parse
+}
+
+// RegisterIdentityParser is like RegisterRecipientParser, but for identity
+// encodings. The native prefixes are "AGE-SECRET-KEY-1", "AGE-PLUGIN-", and
+// "-----BEGIN", which introduces SSH keys and other PEM files.
+func RegisterIdentityParser(prefix string, parse func(string) (Identity, error)) {
+	if parse == nil {
+		panic("age: RegisterIdentityParser called with nil parse function")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.identities == nil {
+		registry.identities = make(map[string]func(string) (Identity, error))
+	}
+	var registered []string
+	for p := range registry.identities {
+		registered = append(registered, p)
+	}
+	checkPrefix("RegisterIdentityParser", prefix, builtinIdentityPrefixes, registered)
+	registry.identities[prefix] = parse
+}
+
+func checkPrefix(fn, prefix string, builtin, registered []string) {
+	if prefix == "" {
+		panic("age: " + fn + " called with empty prefix")
+	}
+	overlaps := func(p string) bool {
+		return strings.HasPrefix(prefix, p) || strings.HasPrefix(p, prefix)
+	}
+	for _, p := range builtin {
+		if overlaps(p) {
+			panic("age: " + fn + ": prefix " + prefix + " overlaps with built-in prefix " + p)
+		}
+	}
+	for _, p := range registered {
+		if overlaps(p) {
+			panic("age: " + fn + ": prefix " + prefix + " overlaps with registered prefix " + p)
+		}
+	}
+}
+
+// LookupRecipientParser returns the parser registered with
+// RegisterRecipientParser for the prefix of s, or nil if there is none.
+func LookupRecipientParser(s string) func(string) (Recipient, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for p, parse := range registry.recipients {
+		if strings.HasPrefix(s, p) {
+			return parse
+		}
+	}
+	return nil
+}
+
+// LookupIdentityParser returns the parser registered with
+// RegisterIdentityParser for the prefix of s, or nil if there is none.
+func LookupIdentityParser(s string) func(string) (Identity, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for p, parse := range registry.identities {
+		if strings.HasPrefix(s, p) {
+			return parse
+		}
+	}
+	return nil
+}
+
+// SupportedRecipientTypes returns the names of the recipient types implemented
+// by this module, such as "X25519", "ssh-ed25519", and "plugin", followed by
+// the prefixes registered with RegisterRecipientParser, in sorted order.
+//
+// Plugins implement further types, which can be discovered by looking for
+// age-plugin-* executables in $PATH.
+func SupportedRecipientTypes() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	var registered []string
+	for p := range registry.recipients {
+		registered = append(registered, p)
+	}
+	sort.Strings(registered)
+	return append(append([]string(nil), builtinTypes...), registered...)
+}
+
+// SupportedIdentityTypes is like SupportedRecipientTypes, but reports the
+// prefixes registered with RegisterIdentityParser.
+func SupportedIdentityTypes() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	var registered []string
+	for p := range registry.identities {
+		registered = append(registered, p)
+	}
+	sort.Strings(registered)
+	return append(append([]string(nil), builtinTypes...), registered...)
+}
@@ -111,7 +111,17 @@ func (r *ScryptRecipient) WrapWithLabels(fileKey []byte) (stanzas []*Stanza, lab
 	return
 }
 
+// ErrIncorrectPassphrase is returned by ScryptIdentity.Unwrap when the file is
+// passphrase-encrypted, but with a different passphrase. It wraps
+// ErrIncorrectIdentity, so Decrypt goes on to try the next identity, and
+// eventually reports it in NoIdentityMatchError.Errors.
+var ErrIncorrectPassphrase = fmt.Errorf("incorrect passphrase: %w", ErrIncorrectIdentity)
+
 // ScryptIdentity is a password-based identity.
+//
+// It fails with a fatal error for files with an scrypt stanza and any other
+// stanza, which the age specification forbids, since anyone who guessed the
+// passphrase could produce a file that also decrypts with other identities.
 type ScryptIdentity struct {
 	password      []byte
 	maxWorkFactor int
@@ -132,7 +142,7 @@ func NewScryptIdentity(password string) (*ScryptIdentity, error) {
 }
 
 // SetMaxWorkFactor sets the maximum accepted scrypt work factor to 2^logN.
-// It must be called before Unwrap.
+// It must be called before Unwrap, and not concurrently with it.
 //
 // This caps the amount of work that Decrypt might have to do to process
 // received files. If SetMaxWorkFactor is not called, a fairly high default is
@@ -200,7 +210,7 @@ func (i *ScryptIdentity) unwrap(block *Stanza) ([]byte, error) {
 	if err == errIncorrectCiphertextSize {
 		return nil, errors.New("invalid scrypt recipient block: incorrect file key size")
 	} else if err != nil {
-		return nil, ErrIncorrectIdentity
+		return nil, ErrIncorrectPassphrase
 	}
 	return fileKey, nil
 }
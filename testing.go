@@ -0,0 +1,36 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build age_testing
+// +build age_testing
+
+package age
+
+import (
+	"errors"
+	"io"
+)
+
+// TestingEncrypt is like Encrypt, but it uses the provided 16-byte file key and
+// 16-byte STREAM nonce instead of generating them randomly.
+//
+// It's meant exclusively for generating reproducible test vectors, like those
+// of the CCTV test suite, and is only available when building with the
+// age_testing build tag. Reusing a file key or nonce completely breaks the
+// security of age, so this must NEVER be used to encrypt real data.
+//
+// Note that recipients might still use their own randomness (e.g. the X25519
+// ephemeral share), so the header is not necessarily deterministic.
+func TestingEncrypt(dst io.Writer, fileKey, nonce []byte, recipients ...Recipient) (io.WriteCloser, error) {
+	if len(fileKey) != fileKeySize {
+		return nil, errors.New("invalid file key size")
+	}
+	if len(nonce) != streamNonceSize {
+		return nil, errors.New("invalid nonce size")
+	}
+	return EncryptWithOptions(dst, []EncryptOption{func(o *encryptOptions) {
+		o.fileKey = fileKey
+		o.nonce = nonce
+	}}, recipients...)
+}
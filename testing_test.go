@@ -0,0 +1,67 @@
+// Copyright 2023 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build age_testing
+// +build age_testing
+
+package age_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestTestingEncrypt(t *testing.T) {
+	i, err := age.NewScryptIdentity("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+
+	fileKey := bytes.Repeat([]byte{1}, 16)
+	nonce := bytes.Repeat([]byte{2}, 16)
+	encrypt := func() []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.TestingEncrypt(buf, fileKey, nonce, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, helloWorld); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	a, b := encrypt(), encrypt()
+
+	// The scrypt salt is random, but the nonce and payload must match.
+	payloadSize := 16 + len(helloWorld) + 16
+	if !bytes.Equal(a[len(a)-payloadSize:], b[len(b)-payloadSize:]) {
+		t.Error("payloads are different")
+	}
+	if !bytes.HasPrefix(a[len(a)-payloadSize:], nonce) {
+		t.Error("nonce not used")
+	}
+
+	out, err := age.Decrypt(bytes.NewReader(a), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
@@ -32,8 +32,11 @@ type X25519Recipient struct {
 
 var _ Recipient = &X25519Recipient{}
 
-// newX25519RecipientFromPoint returns a new X25519Recipient from a raw Curve25519 point.
-func newX25519RecipientFromPoint(publicKey []byte) (*X25519Recipient, error) {
+// NewX25519RecipientFromPoint returns a new X25519Recipient from a raw
+// 32-byte Curve25519 point, such as a NaCl box public key.
+//
+// Most applications should use ParseX25519Recipient instead.
+func NewX25519RecipientFromPoint(publicKey []byte) (*X25519Recipient, error) {
 	if len(publicKey) != curve25519.PointSize {
 		return nil, errors.New("invalid X25519 public key")
 	}
@@ -54,7 +57,7 @@ func ParseX25519Recipient(s string) (*X25519Recipient, error) {
 	if t != "age" {
 		return nil, fmt.Errorf("malformed recipient %q: invalid type %q", s, t)
 	}
-	r, err := newX25519RecipientFromPoint(k)
+	r, err := NewX25519RecipientFromPoint(k)
 	if err != nil {
 		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
 	}
@@ -105,6 +108,25 @@ func (r *X25519Recipient) String() string {
 	return s
 }
 
+// DiscardRecipient is a Recipient whose stanzas can't be unwrapped by any
+// identity. It can be used as a placeholder, for example in configuration
+// templates or in tests.
+//
+// It produces regular X25519 stanzas, encrypted to a freshly generated key
+// which is immediately discarded, so the resulting file is indistinguishable
+// from one encrypted to an X25519Recipient.
+var DiscardRecipient Recipient = discardRecipient{}
+
+type discardRecipient struct{}
+
+func (discardRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	i, err := GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+	return i.Recipient().Wrap(fileKey)
+}
+
 // X25519Identity is the standard age private key, which can decrypt messages
 // encrypted to the corresponding X25519Recipient.
 type X25519Identity struct {
@@ -113,8 +135,17 @@ type X25519Identity struct {
 
 var _ Identity = &X25519Identity{}
 
-// newX25519IdentityFromScalar returns a new X25519Identity from a raw Curve25519 scalar.
-func newX25519IdentityFromScalar(secretKey []byte) (*X25519Identity, error) {
+// NewX25519IdentityFromScalar returns a new X25519Identity from a raw 32-byte
+// Curve25519 scalar, such as a NaCl box or libsodium crypto_box secret key.
+//
+// The scalar is clamped as specified by RFC 7748 every time it's used, so it
+// doesn't need to be clamped in advance, and a clamped and an unclamped
+// encoding of the same key are equivalent. The scalar is stored and returned by
+// String as provided.
+//
+// Most applications should use GenerateX25519Identity or ParseX25519Identity
+// instead.
+func NewX25519IdentityFromScalar(secretKey []byte) (*X25519Identity, error) {
 	if len(secretKey) != curve25519.ScalarSize {
 		return nil, errors.New("invalid X25519 secret key")
 	}
@@ -132,7 +163,22 @@ func GenerateX25519Identity() (*X25519Identity, error) {
 	if _, err := rand.Read(secretKey); err != nil {
 		return nil, fmt.Errorf("internal error: %v", err)
 	}
-	return newX25519IdentityFromScalar(secretKey)
+	return NewX25519IdentityFromScalar(secretKey)
+}
+
+// NewTestIdentityRecipientPair returns a newly generated X25519Identity and
+// its corresponding X25519Recipient. It's meant for tests, and panics if the
+// system random number generator fails, so that callers don't need to check
+// an error.
+//
+// Unlike DiscardRecipient, files encrypted to the returned recipient can be
+// decrypted with the returned identity.
+func NewTestIdentityRecipientPair() (*X25519Identity, *X25519Recipient) {
+	i, err := GenerateX25519Identity()
+	if err != nil {
+		panic("age: " + err.Error())
+	}
+	return i, i.Recipient()
 }
 
 // ParseX25519Identity returns a new X25519Identity from a Bech32 private key
@@ -145,7 +191,7 @@ func ParseX25519Identity(s string) (*X25519Identity, error) {
 	if t != "AGE-SECRET-KEY-" {
 		return nil, fmt.Errorf("malformed secret key: unknown type %q", t)
 	}
-	r, err := newX25519IdentityFromScalar(k)
+	r, err := NewX25519IdentityFromScalar(k)
 	if err != nil {
 		return nil, fmt.Errorf("malformed secret key: %v", err)
 	}